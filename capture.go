@@ -0,0 +1,210 @@
+package sh
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	captureEnvFile  = "env"
+	captureVarsFile = "vars"
+	outputFile      = "output"
+	prologueFile    = "prologue"
+)
+
+// OutputFileEnv is the environment variable of the output file path,
+// the script writes "key=value" lines or multiline values in the form of
+//
+//	key<<EOF
+//	line 1
+//	line 2
+//	EOF
+//
+// to the file and they are parsed into ExecResult.Outputs.
+const OutputFileEnv = "GOSH_OUTPUT"
+
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// initStateDir decides the directory of the files written by the shell and exports
+// the path of the output file, the directory is created when starting.
+func (e *Exec) initStateDir() {
+	e.stateDir = filepath.Join(os.TempDir(), "go-sh-"+e.xid)
+	e.cmd.Env = append(e.cmd.Env, OutputFileEnv+"="+filepath.Join(e.stateDir, outputFile))
+}
+
+// createStateDir creates the directory, the output file and the file of BASH_ENV before the shell starts,
+// they are owned by the user of the shell and removed when it finishes.
+func (e *Exec) createStateDir() error {
+	// the name is unique, an existing directory is never used
+	if err := os.Mkdir(e.stateDir, 0o700); err != nil {
+		return err
+	}
+	e.stateCreated = true
+	if c := e.cmd.SysProcAttr.Credential; c != nil {
+		if err := os.Chown(e.stateDir, int(c.Uid), int(c.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := e.writeStateFile(outputFile, nil); err != nil {
+		return err
+	}
+	if e.prologue == nil {
+		return nil
+	}
+	return e.writeStateFile(prologueFile, e.prologue)
+}
+
+// writeStateFile creates a file of the state dir owned by the user of the shell
+func (e *Exec) writeStateFile(name string, b []byte) error {
+	f, err := os.OpenFile(filepath.Join(e.stateDir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if c := e.cmd.SysProcAttr.Credential; c != nil {
+		if err = f.Chown(int(c.Uid), int(c.Gid)); err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+func (e *Exec) removeStateDir() {
+	if e.stateCreated {
+		_ = os.RemoveAll(e.stateDir)
+	}
+}
+
+// captureCommand returns the commands run by the EXIT trap to write
+// the environment and the variables, the values are separated by NUL.
+func (e *Exec) captureCommand() (string, error) {
+	if !e.opts.CaptureEnv && len(e.opts.CaptureVars) == 0 {
+		return "", nil
+	}
+	for _, name := range e.opts.CaptureVars {
+		if !varNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name: %q", name)
+		}
+	}
+	builder := new(strings.Builder)
+	if e.opts.CaptureEnv {
+		// PATH may be empty or changed by the script
+		env, err := exec.LookPath("env")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(builder, "%s -0 > %s; ", shellQuote(env),
+			shellQuote(filepath.Join(e.stateDir, captureEnvFile)))
+	}
+	if len(e.opts.CaptureVars) > 0 {
+		builder.WriteString("{ :; ")
+		for _, name := range e.opts.CaptureVars {
+			// unset variables are not written
+			fmt.Fprintf(builder, `[ -z "${%[1]s+x}" ] || printf '%[1]s=%%s\0' "$%[1]s"; `, name)
+		}
+		fmt.Fprintf(builder, "} > %s; ", shellQuote(filepath.Join(e.stateDir, captureVarsFile)))
+	}
+	return builder.String(), nil
+}
+
+// readCapture reads the environment and the variables written by the EXIT trap
+func (e *Exec) readCapture() {
+	if !e.stateCreated {
+		return
+	}
+	env := readCaptureFile(filepath.Join(e.stateDir, captureEnvFile))
+	vars := readCaptureFile(filepath.Join(e.stateDir, captureVarsFile))
+	outputs := readOutputFile(filepath.Join(e.stateDir, outputFile))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastEnv = env
+	e.lastVars = vars
+	e.outputs = outputs
+}
+
+func readCaptureFile(name string) map[string]string {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, kv := range bytes.Split(b, []byte{0}) {
+		key, val, ok := strings.Cut(string(kv), "=")
+		if ok && key != "" {
+			m[key] = val
+		}
+	}
+	return m
+}
+
+// readOutputFile parses the output file, the invalid lines are ignored.
+// The multiline value without the end delimiter and the lines after it are ignored.
+func readOutputFile(name string) map[string]string {
+	b, err := os.ReadFile(name)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	outputs := make(map[string]string)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if key, delim, ok := strings.Cut(line, "<<"); ok && key != "" && !strings.Contains(key, "=") {
+			end := -1
+			for j := i + 1; j < len(lines); j++ {
+				if strings.TrimSuffix(lines[j], "\r") == delim {
+					end = j
+					break
+				}
+			}
+			// the rest of the file is the unterminated value, its lines are not parsed
+			if end < 0 {
+				break
+			}
+			outputs[key] = strings.Join(lines[i+1:end], "\n")
+			i = end
+			continue
+		}
+		if key, val, ok := strings.Cut(line, "="); ok && key != "" {
+			outputs[key] = val
+		}
+	}
+	return outputs
+}
+
+// GetLastEnv returns the exported environment when the shell exits,
+// it is nil if ExecOptions.CaptureEnv is not set or the shell did not exit normally.
+func (e *Exec) GetLastEnv() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lastEnv == nil {
+		return nil
+	}
+	env := make(map[string]string, len(e.lastEnv))
+	for k, v := range e.lastEnv {
+		env[k] = v
+	}
+	return env
+}
+
+// GetVar returns the value of the variable when the shell exits.
+// The variables of ExecOptions.CaptureVars are looked up first, then the captured environment.
+func (e *Exec) GetVar(name string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if val, ok := e.lastVars[name]; ok {
+		return val, true
+	}
+	val, ok := e.lastEnv[name]
+	return val, ok
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
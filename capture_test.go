@@ -0,0 +1,130 @@
+package sh
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_Capture(t *testing.T) {
+	for _, sh := range []*shell.Shell{{Type: shell.Sh}, {Type: shell.Bash}} {
+		e, err := NewExec(&ExecOptions{
+			Shell:       sh,
+			CaptureEnv:  true,
+			CaptureVars: []string{"VERSION", "IMAGE_TAG", "UNSET"},
+			Output:      func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run(
+			"VERSION=1.2.3",
+			`IMAGE_TAG="app:$VERSION
+multiline"`,
+			"export BUILD_ID=42",
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := e.GetVar("VERSION"); !ok || v != "1.2.3" {
+			t.Errorf("%s: VERSION: %q, %t", sh.Type, v, ok)
+		}
+		if v, ok := e.GetVar("IMAGE_TAG"); !ok || v != "app:1.2.3\nmultiline" {
+			t.Errorf("%s: IMAGE_TAG: %q, %t", sh.Type, v, ok)
+		}
+		if _, ok := e.GetVar("UNSET"); ok {
+			t.Errorf("%s: UNSET is captured", sh.Type)
+		}
+		if v, ok := e.GetVar("BUILD_ID"); !ok || v != "42" {
+			t.Errorf("%s: BUILD_ID: %q, %t", sh.Type, v, ok)
+		}
+		env := e.GetLastEnv()
+		if _, ok := env["VERSION"]; ok {
+			t.Errorf("%s: VERSION is not exported", sh.Type)
+		}
+		if _, err = os.Stat(e.stateDir); !os.IsNotExist(err) {
+			t.Errorf("%s: state dir is not removed: %v", sh.Type, err)
+		}
+	}
+}
+
+func TestExec_CaptureInvalidName(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewExec(&ExecOptions{
+		CaptureVars: []string{"A; rm -rf /"},
+		Storage:     &Storage{Dir: dir},
+	})
+	if err == nil {
+		t.Fatal("invalid name is accepted")
+	}
+	t.Log(err)
+	// the storage file is removed
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("storage files are left: %d", len(entries))
+	}
+}
+
+func TestExec_StateDirNotStarted(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		CaptureEnv: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(e.stateDir); !os.IsNotExist(err) {
+		t.Errorf("state dir is created before starting: %v", err)
+	}
+	if err = e.Cancel(); !errors.Is(err, ErrCanceled) {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(e.stateDir); !os.IsNotExist(err) {
+		t.Errorf("state dir is created: %v", err)
+	}
+}
+
+func TestExec_Outputs(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run(
+		`echo "version=1.2.3" >> "$GOSH_OUTPUT"`,
+		`echo "expr=a=b<<c" >> "$GOSH_OUTPUT"`,
+		`printf 'notes<<EOF\nline 1\nline 2\nEOF\n' >> "$GOSH_OUTPUT"`,
+		`printf 'invalid\nempty=\n' >> "$GOSH_OUTPUT"`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"version": "1.2.3",
+		"expr":    "a=b<<c",
+		"notes":   "line 1\nline 2",
+		"empty":   "",
+	}
+	outputs := e.Result().Outputs
+	if len(outputs) != len(want) {
+		t.Errorf("outputs: %q", outputs)
+	}
+	for k, v := range want {
+		if outputs[k] != v {
+			t.Errorf("%s: %q, want: %q", k, outputs[k], v)
+		}
+	}
+}
+
+func TestReadOutputFile_Unterminated(t *testing.T) {
+	name := t.TempDir() + "/output"
+	if err := os.WriteFile(name, []byte("a=1\nb<<EOF\nline\nx=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	outputs := readOutputFile(name)
+	if len(outputs) != 1 || outputs["a"] != "1" {
+		t.Errorf("outputs: %q", outputs)
+	}
+}
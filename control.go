@@ -0,0 +1,196 @@
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// controlFd is the fd of the control channel in the shell,
+// it is the first one of cmd.ExtraFiles.
+const controlFd = 3
+
+// outputPipe is the read end of an output pipe.
+// It can be drained on demand, so the output written before a control message
+// is delivered before the message is handled.
+type outputPipe struct {
+	f *os.File
+	// drains receives the drain requests, the ack is closed when the pipe is empty
+	drains chan chan struct{}
+	ack    chan struct{}
+	done   chan struct{} // closed when the reader returns
+}
+
+func newOutputPipe() (*outputPipe, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &outputPipe{
+		f:      r,
+		drains: make(chan chan struct{}, 1),
+		done:   make(chan struct{}),
+	}, w, nil
+}
+
+// Read reads the pipe without blocking while a drain is requested,
+// the drain is done when nothing is left to read.
+func (p *outputPipe) Read(b []byte) (int, error) {
+	for {
+		if p.ack == nil {
+			select {
+			case p.ack = <-p.drains:
+			default:
+			}
+		}
+		if p.ack != nil {
+			n, err := p.readNow(b)
+			if n > 0 {
+				return n, nil
+			}
+			close(p.ack)
+			p.ack = nil
+			if !errors.Is(err, syscall.EAGAIN) {
+				return 0, err
+			}
+		}
+
+		n, err := p.f.Read(b)
+		// interrupted by a drain request
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = p.f.SetReadDeadline(time.Time{})
+			continue
+		}
+		return n, err
+	}
+}
+
+// readNow reads what is in the pipe, it returns syscall.EAGAIN if the pipe is empty
+func (p *outputPipe) readNow(b []byte) (int, error) {
+	conn, err := p.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	var readErr error
+	// Control does not wait for the pipe to be readable like Read
+	err = conn.Control(func(fd uintptr) {
+		for {
+			n, readErr = syscall.Read(int(fd), b)
+			if readErr != syscall.EINTR {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n == 0 && readErr == nil {
+		return 0, io.EOF
+	}
+	return n, readErr
+}
+
+// drain waits until the output in the pipe is delivered, it is called by one goroutine at a time.
+func (p *outputPipe) drain() {
+	ack := make(chan struct{})
+	select {
+	case p.drains <- ack:
+	case <-p.done:
+		return
+	}
+	_ = p.f.SetReadDeadline(time.Now())
+	select {
+	case <-ack:
+	case <-p.done:
+	}
+}
+
+func (p *outputPipe) Close() error {
+	return p.f.Close()
+}
+
+// drainOutput waits until the output written before is delivered
+func (e *Exec) drainOutput() {
+	e.stdout.drain()
+	if e.stderr != nil {
+		e.stderr.drain()
+	}
+}
+
+func (e *Exec) readControl(r io.Reader) {
+	defer e.readers.Done()
+	err := readLines(r, 0, func(line []byte) bool {
+		e.reads.Add(1)
+		return e.parseControl(string(line))
+	})
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+		e.setErr(fmt.Errorf("read control: %s", err), false)
+	}
+}
+
+// parseControl handles a message of the control channel,
+// it returns false after the last message.
+func (e *Exec) parseControl(line string) bool {
+	if _, ok := e.getKey("end", line); ok {
+		e.setFinished()
+		return false
+	}
+
+	if val, ok := e.getKey("err:", line); ok {
+		e.setErrReport(val)
+		return true
+	}
+
+	if val, ok := e.getKey("pwd:", line); ok {
+		e.mu.Lock()
+		e.lastWorkDir = val
+		e.mu.Unlock()
+		return true
+	}
+
+	if val, ok := e.getKey("exit-command:", line); ok {
+		e.mu.Lock()
+		e.exitCommand = e.secrets.mask(val)
+		e.mu.Unlock()
+		return true
+	}
+
+	if val, ok := e.getKey("step:", line); ok {
+		e.startStep(val)
+		return true
+	}
+
+	if val, ok := e.getKey("step-end:", line); ok {
+		e.endStep(val)
+		return true
+	}
+
+	if val, ok := e.getKey("timeout:", line); ok {
+		e.timeoutStep(val)
+		return true
+	}
+
+	if val, ok := e.getKey("batch:", line); ok && e.session != nil {
+		// the output of the batch is written before the message
+		e.drainOutput()
+		e.session.finishBatch(val)
+		return true
+	}
+
+	if val, ok := e.getKey("exit:", line); ok {
+		if code, err := strconv.Atoi(val); err == nil {
+			e.mu.Lock()
+			e.exitCode = &code
+			e.mu.Unlock()
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package sh
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_ControlChannel(t *testing.T) {
+	for _, sh := range []*shell.Shell{{Type: shell.Sh}, {Type: shell.Bash}} {
+		var output []string
+		e, err := NewExec(&ExecOptions{
+			Shell: sh,
+			Output: func(num int, line []byte) {
+				output = append(output, string(line))
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the output containing the xid is not hidden
+		err = e.Run(fmt.Sprintf("echo %s:pwd:/fake", e.xid), "cd /tmp", "echo done")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{e.xid + ":pwd:/fake", "done"}
+		if strings.Join(output, "\n") != strings.Join(want, "\n") || e.GetLastWorkDir() != "/tmp" {
+			t.Errorf("%s: output: %q, last work dir: %s", sh.Type, output, e.GetLastWorkDir())
+		}
+	}
+}
+
+func TestExec_ScriptUsesFd3(t *testing.T) {
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("exec 3>&1", "echo to fd 3 >&3", "exec 3>&-", "cd /")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(output, "\n") != "to fd 3" || e.GetLastWorkDir() != "/" {
+		t.Errorf("output: %q, last work dir: %s", output, e.GetLastWorkDir())
+	}
+}
+
+func TestSession_RunDeliversAllOutput(t *testing.T) {
+	s, err := NewSession(&ExecOptions{
+		SeparateStderr: true,
+		StreamOutput:   func(stream Stream, num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		r, err := s.Run("seq 1 2000", "echo stderr >&2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the traced commands are counted, stdout and stderr are not ordered
+		output := string(r.Output)
+		if n := strings.Count(output, "\n"); n != 2003 || !strings.Contains(output, "\n2000\n") || !strings.Contains(output, "\nstderr\n") {
+			t.Fatalf("batch %d: %d lines", r.Index, n)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package sh
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Coverage is the lines and functions of the script and the files sourced by it that ran.
+type Coverage struct {
+	ID string
+	// Files is the script itself first, then the sourced files sorted by the path
+	Files []*FileCoverage
+}
+
+// FileCoverage is the coverage of a script file.
+type FileCoverage struct {
+	// Source is the path of the sourced file, empty for the script itself
+	Source    string
+	Lines     []CoverageLine
+	Functions []FunctionCoverage
+}
+
+// CoverageLine is a line of the script with the times it ran.
+type CoverageLine struct {
+	Num  int
+	Text string
+	// Executable is false for the lines that are never traced, such as comments, "fi" and "done"
+	Executable bool
+	Count      int
+}
+
+// FunctionCoverage is a function defined in the script with the commands of it that ran.
+type FunctionCoverage struct {
+	Name  string
+	Line  int
+	Count int
+}
+
+// coverage counts the traced commands by the source and line
+type coverage struct {
+	lines     map[string]map[int]int
+	functions map[string]map[string]int
+}
+
+func newCoverage() *coverage {
+	return &coverage{
+		lines:     make(map[string]map[int]int),
+		functions: make(map[string]map[string]int),
+	}
+}
+
+func (c *coverage) add(event CommandEvent) {
+	lines, ok := c.lines[event.Source]
+	if !ok {
+		lines = make(map[int]int)
+		c.lines[event.Source] = lines
+	}
+	lines[event.Line]++
+	if event.Function != "" {
+		functions, ok := c.functions[event.Source]
+		if !ok {
+			functions = make(map[string]int)
+			c.functions[event.Source] = functions
+		}
+		functions[event.Function]++
+	}
+}
+
+var (
+	funcDefRegexp  = regexp.MustCompile(`^\s*(?:function\s+([^\s(){}]+)\s*(?:\(\))?|([^\s(){}]+)\s*\(\))\s*\{?\s*$`)
+	heredocRegexp  = regexp.MustCompile(`(?:^|[^<])<<-?\s*['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+	casePatRegexp  = regexp.MustCompile(`^\s*[^\s()]*\)\s*$`)
+	nonExecutables = map[string]bool{
+		"{": true, "}": true, "(": true, ")": true, "then": true, "else": true,
+		"fi": true, "do": true, "done": true, "esac": true, ";;": true,
+	}
+)
+
+// newFileCoverage annotates the lines of the script with the counts
+func newFileCoverage(source string, script []byte, lines map[int]int, functions map[string]int) *FileCoverage {
+	f := &FileCoverage{Source: source}
+	text := strings.Split(strings.TrimSuffix(string(script), "\n"), "\n")
+	heredoc := ""
+	continued := false
+	for i, line := range text {
+		num := i + 1
+		trimmed := strings.TrimSpace(line)
+		executable := true
+		switch {
+		case heredoc != "":
+			executable = false
+			if strings.TrimLeft(line, "\t") == heredoc {
+				heredoc = ""
+			}
+		case continued:
+			executable = false
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"), nonExecutables[trimmed], casePatRegexp.MatchString(trimmed):
+			executable = false
+		case funcDefRegexp.MatchString(trimmed):
+			executable = false
+			m := funcDefRegexp.FindStringSubmatch(trimmed)
+			name := m[1] + m[2]
+			f.Functions = append(f.Functions, FunctionCoverage{
+				Name:  name,
+				Line:  num,
+				Count: functions[name],
+			})
+		}
+		if heredoc == "" && !continued {
+			if m := heredocRegexp.FindStringSubmatch(line); m != nil {
+				heredoc = m[1]
+			}
+		}
+		continued = strings.HasSuffix(line, "\\")
+		count := lines[num]
+		// the lines are traced even if they look like not executable, such as "( cd /tmp )"
+		if count > 0 {
+			executable = true
+		}
+		f.Lines = append(f.Lines, CoverageLine{
+			Num:        num,
+			Text:       line,
+			Executable: executable,
+			Count:      count,
+		})
+	}
+	return f
+}
+
+// Covered returns the number of the executable lines that ran and all executable lines.
+func (f *FileCoverage) Covered() (covered, total int) {
+	for _, l := range f.Lines {
+		if l.Executable {
+			total++
+			if l.Count > 0 {
+				covered++
+			}
+		}
+	}
+	return covered, total
+}
+
+// Percent returns the percentage of the executable lines that ran.
+func (f *FileCoverage) Percent() float64 {
+	covered, total := f.Covered()
+	if total == 0 {
+		return 100
+	}
+	return float64(covered) / float64(total) * 100
+}
+
+func (f *FileCoverage) name(id string) string {
+	if f.Source == "" {
+		return id
+	}
+	return f.Source
+}
+
+// WriteText writes the annotated source, every executable line is prefixed
+// with the times it ran, or "#####" if it never ran.
+func (c *Coverage) WriteText(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, f := range c.Files {
+		covered, total := f.Covered()
+		fmt.Fprintf(buf, "==> %s: %.1f%% of lines (%d/%d)\n", f.name(c.ID), f.Percent(), covered, total)
+		for _, fn := range f.Functions {
+			fmt.Fprintf(buf, "  function %s (line %d): %d\n", fn.Name, fn.Line, fn.Count)
+		}
+		for _, l := range f.Lines {
+			mark := "-"
+			if l.Executable {
+				mark = "#####"
+				if l.Count > 0 {
+					mark = fmt.Sprint(l.Count)
+				}
+			}
+			fmt.Fprintf(buf, "%9s:%5d: %s\n", mark, l.Num, l.Text)
+		}
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var coverageHTML = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage {{.ID}}</title>
+<style>
+body { font-family: sans-serif; }
+pre { margin: 0; }
+td { padding: 0 8px; font-family: monospace; white-space: pre; vertical-align: top; }
+td.num, td.count { text-align: right; color: #888; }
+tr.covered td.src { background: #dfd; }
+tr.uncovered td.src { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>{{.ID}}</h1>
+{{range .Files}}
+<h2>{{.Name}}: {{printf "%.1f" .Percent}}%</h2>
+{{if .Functions}}<ul>{{range .Functions}}<li>{{.Name}} (line {{.Line}}): {{.Count}}</li>{{end}}</ul>{{end}}
+<table>
+{{range .Lines}}<tr class="{{if .Executable}}{{if .Count}}covered{{else}}uncovered{{end}}{{end}}"><td class="num">{{.Num}}</td><td class="count">{{if .Count}}{{.Count}}{{end}}</td><td class="src">{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the annotated source in HTML, the lines that ran are green and the others are red.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	type file struct {
+		*FileCoverage
+		Name    string
+		Percent float64
+	}
+	data := struct {
+		ID    string
+		Files []file
+	}{ID: c.ID}
+	for _, f := range c.Files {
+		data.Files = append(data.Files, file{FileCoverage: f, Name: f.name(c.ID), Percent: f.Percent()})
+	}
+	return coverageHTML.Execute(w, data)
+}
+
+// WriteFiles writes the reports to "<id>.coverage.txt" and "<id>.coverage.html" in dir.
+func (c *Coverage) WriteFiles(dir string) error {
+	for ext, write := range map[string]func(io.Writer) error{
+		".coverage.txt":  c.WriteText,
+		".coverage.html": c.WriteHTML,
+	} {
+		buf := new(bytes.Buffer)
+		if err := write(buf); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, c.ID+ext), buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exec) buildCoverage() {
+	if e.coverage == nil {
+		return
+	}
+	e.outputMu.Lock()
+	lines, functions := e.coverage.lines, e.coverage.functions
+	e.outputMu.Unlock()
+
+	e.mu.Lock()
+	script := append([]byte(nil), e.script.Bytes()...)
+	e.mu.Unlock()
+	// the lines reporting the batches of Session are not shown
+	lineStart := 0
+	for _, line := range bytes.SplitAfter(script, []byte{'\n'}) {
+		if bytes.Contains(line, []byte(e.xid)) {
+			copy(script[lineStart:], bytes.Repeat([]byte{' '}, len(bytes.TrimSuffix(line, []byte{'\n'}))))
+		}
+		lineStart += len(line)
+	}
+	// the text of the lines is shown, the secrets in it are masked like the output
+	script = e.secrets.maskBytes(script)
+
+	c := &Coverage{ID: e.id}
+	c.Files = append(c.Files, newFileCoverage("", script, lines[""], functions[""]))
+	sources := make([]string, 0, len(lines))
+	for source := range lines {
+		if source != "" {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		// the sourced file may be removed or changed by the script
+		b, err := os.ReadFile(source)
+		if err != nil {
+			continue
+		}
+		c.Files = append(c.Files, newFileCoverage(source, e.secrets.maskBytes(b), lines[source], functions[source]))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.coverageReport = c
+}
+
+// Coverage returns the coverage of the script when ExecOptions.Coverage is set,
+// it is nil if it has not finished running.
+func (e *Exec) Coverage() *Coverage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.coverageReport
+}
@@ -0,0 +1,142 @@
+package sh
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_RunCoverage(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.sh")
+	err := os.WriteFile(lib, []byte("used() {\n  echo used\n}\n\nunused() {\n  echo unused\n}\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewExec(&ExecOptions{
+		Shell:    &shell.Shell{Type: shell.Bash, Set: shell.ErrExit},
+		Coverage: true,
+		Output:   func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run(
+		"source "+lib,
+		"# check the branch",
+		"if [ -n \"$HOME\" ]; then\n  used\nelse\n  unused\nfi",
+		"cat <<EOF\nnot a command\nEOF",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := e.Coverage()
+	if c == nil || c.ID != e.ID() || len(c.Files) != 2 {
+		t.Fatalf("coverage: %+v", c)
+	}
+
+	main := c.Files[0]
+	want := map[int]struct {
+		executable bool
+		covered    bool
+	}{
+		1: {true, true},   // source
+		2: {false, false}, // comment
+		3: {true, true},   // if
+		4: {true, true},   // used
+		5: {false, false}, // else
+		6: {true, false},  // unused
+		7: {false, false}, // fi
+		8: {true, true},   // cat
+		9: {false, false}, // heredoc
+	}
+	for _, l := range main.Lines {
+		if w, ok := want[l.Num]; ok && (l.Executable != w.executable || (l.Count > 0) != w.covered) {
+			t.Errorf("line %d %q: %+v", l.Num, l.Text, l)
+		}
+	}
+	if covered, total := main.Covered(); covered != 4 || total != 5 {
+		t.Errorf("main covered: %d/%d", covered, total)
+	}
+
+	sourced := c.Files[1]
+	if sourced.Source != lib || len(sourced.Functions) != 2 {
+		t.Fatalf("sourced: %+v", sourced)
+	}
+	if f := sourced.Functions[0]; f.Name != "used" || f.Line != 1 || f.Count == 0 {
+		t.Errorf("function: %+v", f)
+	}
+	if f := sourced.Functions[1]; f.Name != "unused" || f.Count != 0 {
+		t.Errorf("function: %+v", f)
+	}
+	if p := sourced.Percent(); p != 50 {
+		t.Errorf("sourced percent: %.1f", p)
+	}
+
+	text := new(bytes.Buffer)
+	if err = c.WriteText(text); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("text:\n%s", text)
+	if !strings.Contains(text.String(), "#####:    6:   unused") {
+		t.Error("uncovered line is not marked")
+	}
+
+	if err = c.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	html, err := os.ReadFile(filepath.Join(dir, e.ID()+".coverage.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(html, []byte(`<tr class="uncovered"><td class="num">6</td>`)) {
+		t.Errorf("html:\n%s", html)
+	}
+}
+
+func TestExec_RunCoverageSecrets(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.sh")
+	if err := os.WriteFile(lib, []byte("TOKEN=hunter2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewExec(&ExecOptions{
+		Shell:    &shell.Shell{Type: shell.Bash},
+		Coverage: true,
+		Secrets:  []string{"hunter2"},
+		Output:   func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("source "+lib, "PASSWORD=hunter2", "echo done"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := e.Coverage()
+	if c == nil || len(c.Files) != 2 {
+		t.Fatalf("coverage: %+v", c)
+	}
+	text := new(bytes.Buffer)
+	if err = c.WriteText(text); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("text:\n%s", text)
+	if strings.Contains(text.String(), "hunter2") {
+		t.Error("secret is not masked")
+	}
+	if !strings.Contains(text.String(), "PASSWORD="+SecretMask) || !strings.Contains(text.String(), "TOKEN="+SecretMask) {
+		t.Error("masked lines are not shown")
+	}
+	// the lines after the masked ones are still covered
+	if covered, total := c.Files[0].Covered(); covered != 3 || total != 3 {
+		t.Errorf("main covered: %d/%d", covered, total)
+	}
+}
@@ -0,0 +1,85 @@
+package sh
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvMode controls which variables of the current process are passed to the shell.
+type EnvMode uint8
+
+const (
+	// EnvDefault uses the global mode, it inherits the whole environment if the global mode is not set.
+	EnvDefault EnvMode = iota
+	// EnvInherit inherits the whole environment of the current process,
+	// it is not overwritten by the global mode.
+	EnvInherit
+	// EnvClean starts with an empty environment, only ExecOptions.Env is set.
+	EnvClean
+	// EnvAllowlist only inherits the variables listed in ExecOptions.EnvAllowlist.
+	EnvAllowlist
+)
+
+func (m EnvMode) String() string {
+	switch m {
+	case EnvClean:
+		return "clean"
+	case EnvAllowlist:
+		return "allowlist"
+	case EnvInherit:
+		return "inherit"
+	}
+	return "default"
+}
+
+// buildEnv returns the environment of the shell process,
+// the variables of env always overwrite the inherited ones.
+func buildEnv(mode EnvMode, allowlist []string, env map[string]string) []string {
+	var base []string
+	switch mode {
+	case EnvClean:
+		base = make([]string, 0, len(env))
+	case EnvAllowlist:
+		base = make([]string, 0, len(allowlist)+len(env))
+		for _, key := range allowlist {
+			if val, ok := os.LookupEnv(key); ok {
+				base = append(base, key+"="+val)
+			}
+		}
+	default:
+		base = os.Environ()
+	}
+
+	if len(env) == 0 {
+		return base
+	}
+
+	result := make([]string, 0, len(base)+len(env))
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := env[key]; !ok {
+			result = append(result, kv)
+		}
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result = append(result, key+"="+env[key])
+	}
+	return result
+}
+
+// lookupEnv returns the last value of key in env, the last one is used by exec.Cmd
+func lookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
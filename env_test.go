@@ -0,0 +1,42 @@
+package sh
+
+import (
+	"testing"
+)
+
+func TestBuildEnv(t *testing.T) {
+	t.Setenv("GO_SH_TEST_A", "a")
+	t.Setenv("GO_SH_TEST_B", "b")
+
+	lookup := func(env []string, key string) (string, bool) {
+		for _, kv := range env {
+			if len(kv) > len(key) && kv[:len(key)+1] == key+"=" {
+				return kv[len(key)+1:], true
+			}
+		}
+		return "", false
+	}
+
+	env := buildEnv(EnvInherit, nil, map[string]string{"GO_SH_TEST_A": "override"})
+	if val, _ := lookup(env, "GO_SH_TEST_A"); val != "override" {
+		t.Errorf("inherit: GO_SH_TEST_A = %q, want override", val)
+	}
+	if val, _ := lookup(env, "GO_SH_TEST_B"); val != "b" {
+		t.Errorf("inherit: GO_SH_TEST_B = %q, want b", val)
+	}
+
+	env = buildEnv(EnvDefault, nil, nil)
+	if val, _ := lookup(env, "GO_SH_TEST_B"); val != "b" {
+		t.Errorf("default: GO_SH_TEST_B = %q, want b", val)
+	}
+
+	env = buildEnv(EnvClean, nil, map[string]string{"TZ": "UTC"})
+	if len(env) != 1 || env[0] != "TZ=UTC" {
+		t.Errorf("clean: %v", env)
+	}
+
+	env = buildEnv(EnvAllowlist, []string{"GO_SH_TEST_B", "GO_SH_TEST_NOT_EXIST"}, nil)
+	if len(env) != 1 || env[0] != "GO_SH_TEST_B=b" {
+		t.Errorf("allowlist: %v", env)
+	}
+}
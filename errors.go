@@ -0,0 +1,207 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tailLines is the number of the last output lines kept in ExitError
+const tailLines = 10
+
+var (
+	ErrUninitialized = errors.New("exec: uninitialized")
+	ErrFinished      = errors.New("exec: already finished")
+	ErrNotStarted    = errors.New("exec: not started")
+	ErrSessionClosed = errors.New("session: closed")
+	// ErrCanceled is reported when the execution is canceled by Exec.Cancel() or its context,
+	// it matches context.Canceled as well.
+	ErrCanceled = fmt.Errorf("exec: canceled: %w", context.Canceled)
+	// ErrTimeout is reported when the deadline of the context is exceeded,
+	// it matches context.DeadlineExceeded as well.
+	ErrTimeout = fmt.Errorf("exec: timed out: %w", context.DeadlineExceeded)
+	// ErrIdleTimeout is reported when no output arrives for ExecOptions.IdleTimeout.
+	ErrIdleTimeout = errors.New("exec: idle timed out")
+	// ErrStepTimeout is matched by ExitError when the shell exits because
+	// a command added by AddCommandWithTimeout timed out.
+	ErrStepTimeout = errors.New("exec: step timed out")
+)
+
+type ExecError struct {
+	ID      string
+	Context context.Context
+	Err     error
+	// Reason is ErrCanceled or ErrTimeout if the execution was stopped
+	Reason error
+}
+
+func (e *ExecError) Error() string {
+	if e.Reason != nil {
+		return e.Reason.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() []error {
+	if e.Reason != nil {
+		return []error{e.Err, e.Reason}
+	}
+	return []error{e.Err}
+}
+
+// ExitError is reported when the shell exits with a non-zero code.
+type ExitError struct {
+	ExitCode int
+	// Command is the last command traced before exiting,
+	// it is empty if xtrace is not enabled.
+	Command string
+	// Lines are the last output lines before exiting
+	Lines []string
+	// Line, Source and Stack are reported by the ERR trap of bash,
+	// Line is 0 if nothing is reported.
+	Line   int
+	Source string
+	Stack  []Frame
+	// Timeout is the timeout of the step failing the shell, it is 0 if no step timed out
+	Timeout time.Duration
+	// Err is nil if the error is reported by a batch of Session, the shell is still alive
+	Err *exec.ExitError
+}
+
+func (e *ExitError) Error() string {
+	builder := new(strings.Builder)
+	if e.Err != nil {
+		builder.WriteString(e.Err.Error())
+	} else {
+		builder.WriteString("exit status ")
+		builder.WriteString(strconv.Itoa(e.ExitCode))
+	}
+	if len(e.Stack) > 0 && e.Stack[0].Function != "" {
+		builder.WriteString(": ")
+		builder.WriteString(e.Stack[0].Function)
+	}
+	if e.Line > 0 {
+		builder.WriteString(": line ")
+		builder.WriteString(strconv.Itoa(e.Line))
+	}
+	if e.Command != "" {
+		builder.WriteString(": ")
+		builder.WriteString(e.Command)
+	}
+	if e.Timeout > 0 {
+		builder.WriteString(": timed out after ")
+		builder.WriteString(e.Timeout.String())
+	}
+	return builder.String()
+}
+
+func (e *ExitError) Unwrap() []error {
+	var errs []error
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	if e.Timeout > 0 {
+		errs = append(errs, ErrStepTimeout)
+	}
+	return errs
+}
+
+// Frame is a function call of the shell, Line is the line being executed in it.
+type Frame struct {
+	Function string
+	Source   string
+	Line     int
+}
+
+// errReport is the failure reported by the ERR trap:
+// code, LINENO, FUNCNAME, BASH_SOURCE, BASH_LINENO and BASH_COMMAND separated by tabs
+type errReport struct {
+	code    int
+	line    int
+	source  string
+	command string
+	stack   []Frame
+	// bashCommand is BASH_COMMAND of the report, command may be replaced by the step
+	bashCommand string
+	// step is the command added by AddCommandWithTimeout that failed
+	step *step
+}
+
+func parseErrReport(val string) (*errReport, error) {
+	fields := strings.SplitN(val, "\t", 6)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid err report: %q", val)
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	line, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	r := &errReport{
+		code:        code,
+		line:        line,
+		command:     fields[5],
+		bashCommand: fields[5],
+	}
+	functions := strings.Fields(fields[2])
+	sources := strings.Fields(fields[3])
+	callerLines := strings.Fields(fields[4])
+	if len(sources) > 0 {
+		r.source = sources[0]
+	}
+	for i, function := range functions {
+		frame := Frame{
+			Function: function,
+			Line:     line,
+		}
+		if i < len(sources) {
+			frame.Source = sources[i]
+		}
+		// BASH_LINENO[i-1] is the line where FUNCNAME[i-1] is called in FUNCNAME[i]
+		if i > 0 && i-1 < len(callerLines) {
+			frame.Line, _ = strconv.Atoi(callerLines[i-1])
+		}
+		r.stack = append(r.stack, frame)
+	}
+	return r, nil
+}
+
+// trimLines subtracts the lines added before the commands of the main script
+func (r *errReport) trimLines(n int, mainSource string) {
+	isMain := func(source string) bool {
+		// the source of the script read from stdin is empty or "main"
+		return source == mainSource || source == "" || source == "main"
+	}
+	if isMain(r.source) && r.line > n {
+		r.line -= n
+	}
+	for i := range r.stack {
+		if isMain(r.stack[i].Source) && r.stack[i].Line > n {
+			r.stack[i].Line -= n
+		}
+	}
+}
+
+func IsDeadlineExceeded(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// traceCommand returns the command of a xtrace line like "+ echo hello world"
+func traceCommand(line string) (string, bool) {
+	trimmed := strings.TrimLeft(line, "+")
+	if len(trimmed) == len(line) || !strings.HasPrefix(trimmed, " ") {
+		return "", false
+	}
+	return trimmed[1:], true
+}
@@ -0,0 +1,158 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExitError(t *testing.T) {
+	e, err := NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("echo before", "(exit 3)", "echo after")
+	t.Log(err)
+
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("%v is not ExitError", err)
+	}
+	if exitErr.ExitCode != 3 || exitErr.Command != "( exit 3 )" || exitErr.Line != 2 {
+		t.Errorf("unexpected exit error: %+v", exitErr)
+	}
+	if n := len(exitErr.Lines); n == 0 || exitErr.Lines[n-1] != "+ exit 3" {
+		t.Errorf("unexpected lines: %q", exitErr.Lines)
+	}
+	var osExitErr *exec.ExitError
+	if !errors.As(err, &osExitErr) {
+		t.Errorf("%v is not exec.ExitError", err)
+	}
+	if IsCanceled(err) || IsDeadlineExceeded(err) {
+		t.Errorf("%v is not stopped", err)
+	}
+
+	if err = e.Run("echo again"); !errors.Is(err, ErrFinished) {
+		t.Errorf("run again: %v", err)
+	}
+}
+
+func TestExitError_StaleReport(t *testing.T) {
+	for _, c := range []struct {
+		commands []string
+		code     int
+		command  string
+	}{
+		{[]string{"false", "echo ok", "exit 3"}, 3, "exit 3"},
+		// the same exit status from another command
+		{[]string{"false", "echo ok", "exit 1"}, 1, "exit 1"},
+		{[]string{"echo ok", "false"}, 1, "false"},
+	} {
+		e, err := NewExec(&ExecOptions{
+			Shell:  &shell.Shell{Type: shell.Bash},
+			Output: func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run(c.commands...)
+		t.Log(err)
+
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("%v is not ExitError", err)
+		}
+		if exitErr.ExitCode != c.code || exitErr.Command != c.command {
+			t.Errorf("%q: unexpected exit error: %+v", c.commands, exitErr)
+		}
+		if c.command != "false" && exitErr.Line != 0 {
+			t.Errorf("%q: the failure of false is reported: %+v", c.commands, exitErr)
+		}
+	}
+}
+
+func TestExecError_Reason(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	e, err := NewExecContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("sleep 10")
+	t.Log(err)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) || !IsDeadlineExceeded(err) {
+		t.Errorf("%v is not timeout", err)
+	}
+
+	e, err = NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = e.Cancel()
+	}()
+	err = e.Run("sleep 10")
+	t.Log(err)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("%v is not canceled", err)
+	}
+}
+
+func TestExitError_Stack(t *testing.T) {
+	for _, storage := range []*Storage{nil, {Dir: t.TempDir(), NotAutoClean: true}} {
+		e, err := NewExec(&ExecOptions{
+			Storage: storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = e.AddRawCommand([]byte(`
+deploy() {
+  echo deploying
+  false
+}
+main() {
+  deploy
+}
+main
+`))
+		err = e.Run()
+		t.Log(err)
+
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("%v is not ExitError", err)
+		}
+		if exitErr.Command != "false" || exitErr.Line != 4 {
+			t.Errorf("unexpected exit error: %+v", exitErr)
+		}
+		if len(exitErr.Stack) < 2 ||
+			exitErr.Stack[0] != (Frame{Function: "deploy", Source: exitErr.Source, Line: 4}) ||
+			exitErr.Stack[1] != (Frame{Function: "main", Source: exitErr.Source, Line: 7}) {
+			t.Errorf("unexpected stack: %+v", exitErr.Stack)
+		}
+	}
+}
+
+func TestParseErrReport(t *testing.T) {
+	r, err := parseErrReport("1\t5\tf main\t/tmp/a /tmp/a\t9 0\techo a\tb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.trimLines(1, "/tmp/a")
+	if r.code != 1 || r.line != 4 || r.source != "/tmp/a" || r.command != "echo a\tb" {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	want := []Frame{{"f", "/tmp/a", 4}, {"main", "/tmp/a", 8}}
+	if len(r.stack) != 2 || r.stack[0] != want[0] || r.stack[1] != want[1] {
+		t.Errorf("unexpected stack: %+v", r.stack)
+	}
+	if _, err = parseErrReport("1\t2"); err == nil {
+		t.Error("invalid report is parsed")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/zdz1715/go-sh"
+)
+
+func main() {
+	e1, err := sh.NewExec()
+	if err != nil {
+		fmt.Printf("new exec fail:%s\n", err)
+		return
+	}
+	e2, err := sh.NewExec()
+	if err != nil {
+		fmt.Printf("new exec fail:%s\n", err)
+		return
+	}
+
+	if err = e1.Start("sleep 1", "echo e1"); err != nil {
+		fmt.Printf("start fail:%s\n", err)
+		return
+	}
+	if err = e2.Start("sleep 10", "echo e2"); err != nil {
+		fmt.Printf("start fail:%s\n", err)
+		return
+	}
+
+	// e1先结束后取消e2
+	select {
+	case <-e1.Done():
+		e2.Cancel()
+	case <-e2.Done():
+		e1.Cancel()
+	}
+
+	err1, err2 := e1.Wait(), e2.Wait()
+	fmt.Printf("e1: %s, err: %v\n", e1.State(), err1)
+	fmt.Printf("e2: %s, err: %v\n", e2.State(), err2)
+}
+
+/*
++ sleep 1
++ sleep 10
++ echo e1
+e1
+e1: succeeded, err: <nil>
+e2: canceled, err: exec: canceled: context canceled
+*/
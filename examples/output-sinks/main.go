@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zdz1715/go-sh"
+)
+
+func main() {
+	logs := &sh.FileSink{Dir: os.TempDir()}
+	defer logs.Close()
+
+	e, err := sh.NewExec(&sh.ExecOptions{
+		OutputHandler: sh.MultiSink(
+			sh.PrefixSink(sh.WriterSink(os.Stdout), nil),
+			sh.JSONSink(os.Stdout),
+			logs,
+		),
+	})
+	if err != nil {
+		fmt.Printf("new exec fail:%s\n", err)
+		return
+	}
+
+	if err = e.Run("echo hello world"); err != nil {
+		fmt.Printf("exec fail:%s\n", err)
+	}
+	fmt.Printf("log file: %s\n", logs.Path(e.ID()))
+}
+
+/*
+[cs3t9b2p2g0b1nq4d1a0] + echo hello world
+{"exec_id":"cs3t9b2p2g0b1nq4d1a0","stream":"stdout","num":1,"time":"2024-10-18T15:04:05.123456+08:00","elapsed":1.62,"xtrace":true,"line":"+ echo hello world"}
+[cs3t9b2p2g0b1nq4d1a0] hello world
+{"exec_id":"cs3t9b2p2g0b1nq4d1a0","stream":"stdout","num":2,"time":"2024-10-18T15:04:05.123789+08:00","elapsed":1.95,"line":"hello world"}
+log file: /tmp/cs3t9b2p2g0b1nq4d1a0.log
+*/
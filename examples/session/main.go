@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/zdz1715/go-sh"
+)
+
+func main() {
+	s, err := sh.NewSession()
+	if err != nil {
+		fmt.Printf("new session fail:%s\n", err)
+		return
+	}
+	defer s.Close()
+
+	// 函数、变量和工作目录在多次执行之间保留
+	if _, err = s.Run("hello() { echo hello $1; }", "NAME=world", "cd /tmp"); err != nil {
+		fmt.Printf("run fail:%s\n", err)
+		return
+	}
+
+	r, err := s.Run("hello $NAME")
+	if err != nil {
+		fmt.Printf("run fail:%s\n", err)
+		return
+	}
+	fmt.Printf("batch %d exit code: %d, work dir: %s, output: %q\n", r.Index, r.ExitCode, r.LastWorkDir, r.Output)
+}
+
+/*
++ NAME=world
++ cd /tmp
++ hello world
++ echo hello world
+hello world
+batch 2 exit code: 0, work dir: /tmp, output: "+ hello world\n+ echo hello world\nhello world\n"
+*/
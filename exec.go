@@ -1,7 +1,6 @@
 package sh
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -10,28 +9,95 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/rs/xid"
+	"github.com/zdz1715/go-sh/shell"
 )
 
+// outputWaitDelay is how long to wait for the output after the shell exits
+// when no output is read anymore
+const outputWaitDelay = 2 * time.Second
+
 type Exec struct {
-	id             string
-	xid            string
-	lastWorkDir    string // 执行完毕后工作目录位置
-	cmd            *exec.Cmd
-	ctx            context.Context
-	err            error
-	file           *os.File
-	finished       bool
-	finishedRawLen int
-	hide           bool
-	opts           *ExecOptions
-
-	stdin  io.WriteCloser
-	stdout io.ReadCloser
+	id          string
+	xid         string
+	cmd         *exec.Cmd
+	ctx         context.Context
+	file        *os.File
+	startRawLen int    // the traps written before the commands of sh, see addStartRawCommand
+	prologue    []byte // the traps read by bash from BASH_ENV
+	opts        *ExecOptions
+	session     *Session // the shell of the session if it is not nil
+	handler     OutputHandler
+	secrets     *secretMasker
+	stateDir    string // files written by the shell, such as the captured environment
+	// stateCreated is set when stateDir is created by Start
+	stateCreated bool
+
+	// mu guards the state below, it is written by the output goroutines
+	// and read by the methods called from any goroutine
+	mu          sync.Mutex
+	lastWorkDir string // 执行完毕后工作目录位置
+	err         error
+	startLines  int // lines of the batches run before in the session, LINENO needs to subtract it
+	started     bool
+	finished    bool
+	canceled    bool
+	// idleTimedOut is set when it is stopped by ExecOptions.IdleTimeout
+	idleTimedOut bool
+	pid          int
+	exitCode     *int // exit status reported by the EXIT trap
+	errReport    *errReport
+	// exitCommand is the command exiting the shell reported before the EXIT trap of the script
+	exitCommand string
+	startTime   time.Time
+	result      *ExecResult
+	done        chan struct{}
+	doneOnce    sync.Once
+	exited      chan struct{} // closed when the process group has exited
+	lastEnv     map[string]string
+	lastVars    map[string]string
+	outputs     map[string]string
+	profile     *Profile
+	// steps are the running commands added by AddCommandWithTimeout by the process group
+	steps        map[int]*step
+	lastStep     *step
+	stepTimeouts []StepTimeout
+	// script is the commands written after the traps for Coverage and RunWithRetry, see recordsScript
+	script         bytes.Buffer
+	coverageReport *Coverage
+	// replay is the script of the failed attempt written by Start, see RunWithRetry
+	replay []byte
+	// recordScript is set by RunWithRetry to keep the commands in script
+	recordScript bool
+
+	stdin   io.WriteCloser
+	stdout  *outputPipe
+	stderr  *outputPipe
+	control *os.File // the read end of the control channel
+	// the write ends of the output pipes are only held by the shell after starting
+	closeAfterStart []io.Closer
+	readers         sync.WaitGroup
+	reads           atomic.Int64
+	lastOutput      atomic.Int64 // unix nano of the last output for IdleTimeout
+
+	// outputMu keeps the lines of stdout and stderr in order
+	outputMu sync.Mutex
+	num      int
+	bytes    int64
+	// the last traced command and output lines for ExitError
+	lastCommand string
+	tail        []string
+	stepLine    int // the line of the last step traced
+	profiler    *profiler
+	coverage    *coverage
 }
 
 func NewExec(execOpts ...*ExecOptions) (*Exec, error) {
@@ -42,16 +108,28 @@ func NewExecContext(ctx context.Context, execOpts ...*ExecOptions) (*Exec, error
 	opts := GlobalExecOptionsOverwrite(execOpts...)
 
 	e := &Exec{
-		id:   opts.IDCreator(),
-		xid:  xid.New().String(),
-		ctx:  ctx,
-		opts: opts,
+		id:      opts.IDCreator(),
+		xid:     xid.New().String(),
+		ctx:     ctx,
+		opts:    opts,
+		handler: opts.outputHandler(),
+		secrets: newSecretMasker(opts.Secrets...),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
 	}
 
 	if e.id == "" {
 		return nil, errors.New("id is empty")
 	}
 
+	// the files already created are released if it fails
+	initialized := false
+	defer func() {
+		if !initialized {
+			e.release()
+		}
+	}()
+
 	valid, err := CheckStorage(opts.Storage)
 	if err != nil {
 		return nil, err
@@ -65,9 +143,20 @@ func NewExecContext(ctx context.Context, execOpts ...*ExecOptions) (*Exec, error
 		e.cmd = exec.CommandContext(ctx, opts.Shell.Path(), args...)
 	} else {
 		e.cmd = exec.CommandContext(ctx, opts.Shell.Path(), opts.Shell.GetFullArgs()...)
-		if e.stdin, err = e.cmd.StdinPipe(); err != nil {
+		// the read end is closed after starting, or by Cancel if it is never started
+		stdin, w, err := os.Pipe()
+		if err != nil {
 			return nil, err
 		}
+		e.cmd.Stdin = stdin
+		e.stdin = w
+		e.closeAfterStart = append(e.closeAfterStart, stdin)
+	}
+
+	// the context stops the process group by the stop policy instead of killing the shell only
+	e.cmd.Cancel = func() error {
+		e.stop()
+		return nil
 	}
 
 	e.cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -93,25 +182,90 @@ func NewExecContext(ctx context.Context, execOpts ...*ExecOptions) (*Exec, error
 		e.cmd.Dir = opts.WorkDir
 	}
 
-	if e.stdout, err = e.cmd.StdoutPipe(); err != nil {
+	e.cmd.Env = buildEnv(opts.EnvMode, opts.EnvAllowlist, opts.Env)
+	e.initStateDir()
+
+	if err = e.addStartRawCommand(); err != nil {
+		return nil, err
+	}
+
+	// the pipes are created here instead of cmd.StdoutPipe(),
+	// cmd.Wait() closes them as soon as the shell exits and the unread output is lost
+	var stdout, stderr, control *os.File
+	if e.stdout, stdout, err = newOutputPipe(); err != nil {
 		return nil, err
 	}
-	// redirect stderr to stdout
-	e.cmd.Stderr = e.cmd.Stdout
+	e.cmd.Stdout = stdout
+	e.closeAfterStart = append(e.closeAfterStart, stdout)
+	if opts.SeparateStderr {
+		if e.stderr, stderr, err = newOutputPipe(); err != nil {
+			return nil, err
+		}
+		e.cmd.Stderr = stderr
+		e.closeAfterStart = append(e.closeAfterStart, stderr)
+	} else {
+		// redirect stderr to stdout
+		e.cmd.Stderr = stdout
+	}
 
+	// the markers are written to the control channel, they are never mixed with the output
+	if e.control, control, err = os.Pipe(); err != nil {
+		return nil, err
+	}
+	e.cmd.ExtraFiles = []*os.File{control}
+	e.closeAfterStart = append(e.closeAfterStart, control)
+
+	initialized = true
 	return e, nil
 }
 
+// release closes the files of the execution failed to initialize and removes the storage file
+func (e *Exec) release() {
+	for _, c := range e.closeAfterStart {
+		_ = c.Close()
+	}
+	if e.stdout != nil {
+		_ = e.stdout.Close()
+	}
+	if e.stderr != nil {
+		_ = e.stderr.Close()
+	}
+	if e.control != nil {
+		_ = e.control.Close()
+	}
+	if e.stdin != nil {
+		_ = e.stdin.Close()
+	}
+	if e.file != nil {
+		_ = os.Remove(e.file.Name())
+	}
+}
+
 func (e *Exec) ID() string {
 	return e.id
 }
 
 func (e *Exec) GetLastWorkDir() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.lastWorkDir
 }
 
+// Result returns the summary of the execution, nil if it has not finished running.
+func (e *Exec) Result() *ExecResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.result == nil {
+		return nil
+	}
+	r := *e.result
+	return &r
+}
+
 // Finished returns the value of whether it is finished
 func (e *Exec) Finished() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.finished
 }
 
@@ -126,43 +280,126 @@ func (e *Exec) setErr(err error, force bool) {
 	if err == nil {
 		return
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if force || e.err == nil {
 		e.err = &ExecError{
 			ID:      e.id,
 			Context: e.ctx,
 			Err:     err,
+			Reason:  e.stopReason(),
 		}
 	}
 }
 
-func (e *Exec) setFinished() {
-	if !e.finished {
-		e.finished = true
-		var err error
-		if e.opts.Storage != nil && e.file != nil {
-			err = e.opts.Storage.RemoveOrTruncate(e.file, int64(e.finishedRawLen))
-			e.setErr(err, false)
-		}
-		if err = e.stdin.Close(); err != nil {
-			e.setErr(err, false)
+// stopReason returns why the execution was stopped, nil if it was not stopped.
+// It must be called with mu held.
+func (e *Exec) stopReason() error {
+	switch {
+	case e.idleTimedOut:
+		return ErrIdleTimeout
+	case errors.Is(e.ctx.Err(), context.DeadlineExceeded):
+		return ErrTimeout
+	case e.canceled || e.ctx.Err() != nil:
+		return ErrCanceled
+	}
+	return nil
+}
+
+func (e *Exec) exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return e.newExitError(exitErr.ExitCode(), exitErr)
+}
+
+func (e *Exec) newExitError(code int, err *exec.ExitError) *ExitError {
+	e.outputMu.Lock()
+	exitError := &ExitError{
+		ExitCode: code,
+		Command:  e.lastCommand,
+		Lines:    append([]string(nil), e.tail...),
+		Err:      err,
+	}
+	e.outputMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// the report of a failure followed by other commands is not the cause of the exit status,
+	// e.g. "false; echo ok; exit 3" without errexit
+	if r := e.errReport; r != nil && r.code == code && (e.exitCommand == "" || e.exitCommand == r.bashCommand) {
+		exitError.Command = r.command
+		exitError.Line = r.line
+		exitError.Source = r.source
+		exitError.Stack = r.stack
+		if r.step != nil && r.step.timedOut && code == StepTimeoutExitCode {
+			exitError.Timeout = r.step.timeout
 		}
+	} else if e.exitCommand != "" {
+		exitError.Command = e.exitCommand
+	}
+	return exitError
+}
 
-		if e.cmd.Process.Pid > 0 {
-			// 关闭进程组，包括子进程
-			// 只调用c.cmd.Process.Kill()，子进程不会被杀死，原因来自go语言
-			// see: https://github.com/golang/go/issues/23019
-			_ = syscall.Kill(-e.cmd.Process.Pid, syscall.SIGKILL)
+func (e *Exec) setFinished() {
+	e.mu.Lock()
+	if e.finished {
+		e.mu.Unlock()
+		return
+	}
+	e.finished = true
+	e.mu.Unlock()
+
+	var err error
+	if e.opts.Storage != nil && e.file != nil {
+		err = e.opts.Storage.RemoveOrStrip(e.file, int64(e.startRawLen), 0)
+		// the stored script is kept
+		if err == nil && e.opts.Storage.NotAutoClean && !e.secrets.empty() {
+			err = e.opts.Storage.Replace(e.file, e.secrets.maskBytes)
 		}
+		e.setErr(err, false)
+	}
+	if err = e.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		e.setErr(err, false)
 	}
 }
 
-// Cancel this execution
+// Cancel this execution, it is safe to call from any goroutine.
 func (e *Exec) Cancel() error {
-	defer e.setFinished()
+	e.mu.Lock()
+	canceled := !e.finished
+	started := e.started
+	if canceled {
+		e.canceled = true
+	}
+	e.mu.Unlock()
+
+	if canceled {
+		e.stop()
+	}
+	e.setFinished()
+	// nothing will be waited if it is canceled before starting
+	if canceled && !started {
+		e.setErr(ErrCanceled, false)
+		e.closeOutput()
+		for _, c := range e.closeAfterStart {
+			_ = c.Close()
+		}
+		e.removeStateDir()
+		e.closeDone()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.err
 }
 
 func (e *Exec) AddCommand(name string, args ...string) error {
+	return e.AddRawCommand(commandRaw(name, args...))
+}
+
+func commandRaw(name string, args ...string) []byte {
 	if name == "" {
 		return nil
 	}
@@ -177,138 +414,471 @@ func (e *Exec) AddCommand(name string, args ...string) error {
 		builder.WriteByte(' ')
 		builder.WriteString(arg)
 	}
-	raw := append(bytes.TrimSpace(builder.Bytes()), '\n')
-	return e.AddRawCommand(raw)
+	return append(bytes.TrimSpace(builder.Bytes()), '\n')
 }
 
+// AddRawCommand adds the raw commands to the script.
+// The commands of stdin are written by Start, they cannot be added after starting except for Session.
 func (e *Exec) AddRawCommand(raw []byte) error {
+	e.mu.Lock()
+	started := e.started
+	e.mu.Unlock()
+	if started && e.file == nil && e.session == nil {
+		return os.ErrClosed
+	}
+	return e.writeRaw(raw)
+}
+
+func (e *Exec) writeRaw(raw []byte) error {
 	if len(raw) == 0 {
 		return nil
 	}
 	if _, err := e.stdin.Write(raw); err != nil {
 		return err
 	}
+	e.mu.Lock()
+	if e.recordsScript() {
+		e.script.Write(raw)
+	}
+	e.mu.Unlock()
 	return nil
 }
 
-func (e *Exec) key(key string) string {
-	return fmt.Sprintf("%s:%s", e.xid, key)
+// recordsScript reports whether the commands are kept for Coverage or RunWithRetry.
+// The commands written to stdin before starting are kept for RunWithRetry, they cannot be read back
+// and are limited by the pipe buffer, the ones in the storage file are read by RunWithRetry.
+// It must be called with mu held.
+func (e *Exec) recordsScript() bool {
+	if e.coverage != nil || e.recordScript {
+		return true
+	}
+	return e.file == nil && e.session == nil && !e.started
 }
 
-func (e *Exec) echoKey(key string, dbQuote ...bool) string {
-	if len(dbQuote) > 0 && dbQuote[0] {
-		return fmt.Sprintf(`echo "%s"`, e.key(key))
-	}
-	return fmt.Sprintf("echo '%s'", e.key(key))
+func (e *Exec) key(key string) string {
+	return fmt.Sprintf("%s:%s", e.xid, key)
 }
 
 func (e *Exec) getKey(key, line string) (val string, found bool) {
 	return strings.CutPrefix(line, e.key(key))
 }
 
-func (e *Exec) addFinishedRawCommand() error {
+// addStartRawCommand adds the traps reporting the state of the shell to the control channel,
+// the line numbers of the script are not changed by them.
+// The markers are prefixed with the xid, the lines written to the channel by others are ignored.
+//
+// Bash reads them from the file of BASH_ENV before the script, see createStateDir,
+// BASH_ENV is restored to the one of the environment, so the shells run by the script do not read it.
+// It is not read in the posix or privileged mode, then they are written like sh.
+// Sh reads them in the same line as the first command.
+//
+// The EXIT trap waits for the background jobs and reports the last work dir and exit status,
+// so they are reported even if the script exits early.
+// The ERR trap reports the failing command and the function stack, it is only supported by bash.
+// The EXIT and ERR traps set by the script are chained with them in bash, see trapCommand.
+// In sh and the posix mode of bash, the EXIT trap set by the script replaces the one reporting the state,
+// then the last work dir is empty and the exit status is read from the process.
+func (e *Exec) addStartRawCommand() error {
+	isBash := e.opts.Shell != nil && e.opts.Shell.Type == shell.Bash
+	bashEnv := isBash && e.opts.Shell.Set&(shell.Posix|shell.Privileged) == 0
 	builder := new(bytes.Buffer)
-	builder.WriteString(e.echoKey("start"))
-	builder.WriteByte('\n')
-	builder.WriteString("set +x")
-	builder.WriteByte('\n')
-	builder.WriteString("wait")
-	builder.WriteByte('\n')
-	builder.WriteString(e.echoKey("pwd:$(pwd)", true))
-	builder.WriteByte('\n')
-	builder.WriteString(e.echoKey("end"))
-	builder.WriteByte('\n')
+	origEnv, hasOrigEnv := lookupEnv(e.cmd.Env, "BASH_ENV")
+	if bashEnv && hasOrigEnv {
+		// the file of the environment is read before like bash does
+		fmt.Fprintf(builder, "[ ! -f %[1]s ] || . %[1]s\n", shellQuote(origEnv))
+	}
+	builder.WriteString("{ ")
+	if isBash {
+		// move the control channel to a free fd, so fd 3 is left to the script
+		fmt.Fprintf(builder, "exec {__gosh_ctl}>&%d %d>&-; ", controlFd, controlFd)
+	} else {
+		fmt.Fprintf(builder, "__gosh_ctl=%d; ", controlFd)
+	}
+	if bashEnv {
+		if hasOrigEnv {
+			builder.WriteString("BASH_ENV=" + shellQuote(origEnv) + "; ")
+		} else {
+			builder.WriteString("unset BASH_ENV; ")
+		}
+	}
+	capture, err := e.captureCommand()
+	if err != nil {
+		return err
+	}
+	// bash runs the EXIT trap in a subshell killed by a signal, only the shell itself reports.
+	// wait fails with the status of a job reaped before when job control has been enabled by a step
+	builder.WriteString(`__gosh_exit() { [ "${BASHPID:-$$}" = "$$" ] || return "$1"; wait || :; `)
+	builder.WriteString(capture)
+	if isBash {
+		// the ERR report is only used if it is the command exiting the shell
+		builder.WriteString(e.printfKey("exit-command:%s", `"${BASH_COMMAND//$'\n'/ }"`))
+	}
+	builder.WriteString(e.printfKey("pwd:%s", `"$(pwd)"`))
+	builder.WriteString(e.printfKey("exit:%s", `"$1"`))
+	builder.WriteString(e.printfKey("end", ""))
+	builder.WriteString(`exit "$1"; }; `)
+	builder.WriteString("trap '" + exitTrap + "' EXIT; ")
+	if isBash {
+		builder.WriteString("__gosh_err() { ")
+		builder.WriteString(e.printfKey(`err:%s\t%s\t%s\t%s\t%s\t%s`,
+			`"$1" "$2" "${FUNCNAME[*]:1}" "${BASH_SOURCE[*]:1}" "${BASH_LINENO[*]:1}" "${BASH_COMMAND//$'\n'/ }"`))
+		builder.WriteString(`return "$1"; }; `)
+		builder.WriteString("trap '" + errTrap + "' ERR; ")
+		// the ERR trap is inherited by functions
+		builder.WriteString("set -E; ")
+		// a function cannot be named trap in the posix mode, the traps of the script replace them like sh
+		if e.opts.Shell.Set&shell.Posix == 0 {
+			builder.WriteString(e.trapCommand())
+		}
+		builder.WriteString(e.stepTimeoutCommand())
+		// the raw output keeps the default PS4
+		if e.opts.ChunkOutput == nil {
+			builder.WriteString(e.ps4())
+			// the profile and coverage are measured by the traced commands
+			if e.opts.Profile {
+				e.profiler = newProfiler()
+			}
+			if e.opts.Coverage {
+				e.coverage = newCoverage()
+			}
+			if e.opts.Profile || e.opts.Coverage {
+				builder.WriteString("set -x; ")
+			}
+		}
+	}
+	builder.WriteString("} 2>/dev/null")
+
+	if bashEnv {
+		builder.WriteByte('\n')
+		e.prologue = builder.Bytes()
+		e.cmd.Env = append(e.cmd.Env, "BASH_ENV="+filepath.Join(e.stateDir, prologueFile))
+		return nil
+	}
+	// the first command follows in the same line
+	builder.WriteString("; ")
 	raw := builder.Bytes()
-	e.finishedRawLen = len(raw)
-	return e.AddRawCommand(raw)
+	if _, err = e.stdin.Write(raw); err != nil {
+		return err
+	}
+	e.startRawLen = len(raw)
+	return nil
 }
 
-func (e *Exec) parseOutput(num int, lineByte []byte) bool {
-	line := bytesToString(lineByte)
-	if _, ok := e.getKey("end", line); ok {
-		e.setFinished()
-		return false
+// printfKey returns a printf command writing the key with args to the control channel
+func (e *Exec) printfKey(format string, args string) string {
+	if args != "" {
+		args = " " + args
 	}
+	return fmt.Sprintf(`printf '%%s:%s\n' '%s'%s >&"$__gosh_ctl"; `, format, e.xid, args)
+}
 
-	if _, ok := e.getKey("start", line); ok {
-		e.hide = true
-		return true
+func (e *Exec) output(stream Stream, line []byte) {
+	if e.opts == nil {
+		return
 	}
-
-	if e.hide {
-		if val, ok := e.getKey("pwd:", line); ok {
-			e.lastWorkDir = val
-			return true
+	now := time.Now()
+	line = e.secrets.maskBytes(line)
+	text := string(line)
+	command, xtrace := traceCommand(text)
+	if event, ok := e.parseTrace(stream, text); ok {
+		command, xtrace = event.Command, true
+		if e.profiler != nil {
+			e.profiler.add(event)
+		}
+		if e.coverage != nil {
+			e.coverage.add(event)
+		}
+		if e.opts.CommandHandler != nil {
+			e.lastCommand = command
+			e.opts.CommandHandler(event)
+			return
 		}
+		// the trace line is delivered in the form of the default PS4
+		text = event.String()
+		line = []byte(text)
+	}
+	if xtrace {
+		e.lastCommand = command
+	}
+	e.num++
+	e.bytes += int64(len(line))
+	if len(e.tail) == tailLines {
+		e.tail = append(e.tail[:0], e.tail[1:]...)
+	}
+	e.tail = append(e.tail, text)
+	if e.session != nil {
+		e.session.collect(line)
 	}
+	if e.handler != nil {
+		e.handler.HandleLine(Line{
+			ExecID: e.id,
+			Stream: stream,
+			Num:    e.num,
+			Time:   now,
+			// startTime is set before the output goroutines start
+			Elapsed: now.Sub(e.startTime),
+			XTrace:  xtrace,
+			Data:    append([]byte(nil), line...),
+		})
+	}
+}
 
-	if e.opts != nil && e.opts.Output != nil &&
-		!e.hide && !strings.Contains(line, e.xid) {
-		e.opts.Output(num, lineByte)
+// chunkOutput delivers the raw output, the lines of ExitError are not kept,
+// and the secrets split into two chunks are not masked
+func (e *Exec) chunkOutput(stream Stream, chunk []byte) {
+	chunk = e.secrets.maskBytes(chunk)
+	e.num++
+	e.bytes += int64(len(chunk))
+	if e.session != nil {
+		e.session.collectChunk(chunk)
 	}
+	e.opts.ChunkOutput(stream, chunk)
+}
 
-	return true
+func (e *Exec) readOutput(stream Stream, p *outputPipe) {
+	defer e.readers.Done()
+	defer close(p.done)
+	var err error
+	if e.opts.ChunkOutput != nil {
+		err = readChunks(p, func(chunk []byte) {
+			e.reads.Add(1)
+			e.touchOutput()
+			e.outputMu.Lock()
+			e.chunkOutput(stream, chunk)
+			e.outputMu.Unlock()
+		})
+	} else {
+		err = readLines(p, e.opts.MaxLineSize, func(line []byte) bool {
+			e.reads.Add(1)
+			e.touchOutput()
+			e.outputMu.Lock()
+			e.output(stream, line)
+			e.outputMu.Unlock()
+			return true
+		})
+	}
+	// the pipe is closed by waitOutput() if it is held by other processes
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+		e.setErr(fmt.Errorf("read: %s", err), false)
+	}
 }
 
+// Run starts the execution and waits for it to finish.
 func (e *Exec) Run(command ...string) error {
+	if err := e.Start(command...); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// Start starts the execution without waiting for it to finish,
+// the commands are added after the commands added before.
+// The commands of stdin are written in the background, it does not wait for the shell to read them.
+func (e *Exec) Start(command ...string) error {
 	if e.cmd == nil {
-		return errors.New("exec: uninitialized")
+		return ErrUninitialized
 	}
 
-	if e.finished {
-		return errors.New("exec: already finished")
+	e.mu.Lock()
+	if e.finished || e.started {
+		e.mu.Unlock()
+		return ErrFinished
+	}
+	e.started = true
+	e.startTime = time.Now()
+	e.mu.Unlock()
+
+	// the state dir is created here, an execution never started leaves nothing behind
+	err := e.createStateDir()
+	// the script file is complete before the shell reads it
+	if err == nil && e.file != nil {
+		err = e.addCommands(command...)
+	}
+	if err == nil {
+		err = e.cmd.Start()
+	}
+	for _, c := range e.closeAfterStart {
+		_ = c.Close()
+	}
+	if err != nil {
+		e.closeOutput()
+		e.removeStateDir()
+		e.mu.Lock()
+		e.err = err
+		e.mu.Unlock()
+		e.setFinished()
+		e.closeDone()
+		return err
 	}
 
-	defer e.setFinished()
+	e.mu.Lock()
+	e.pid = e.cmd.Process.Pid
+	canceled := e.canceled
+	e.mu.Unlock()
+	// canceled while starting
+	if canceled {
+		e.stop()
+	}
 
-	var err error
-	if err = e.cmd.Start(); err != nil {
-		return err
+	e.readers.Add(1)
+	go e.readOutput(Stdout, e.stdout)
+	if e.stderr != nil {
+		e.readers.Add(1)
+		go e.readOutput(Stderr, e.stderr)
+	}
+	e.readers.Add(1)
+	go e.readControl(e.control)
+	if e.opts.IdleTimeout > 0 {
+		e.touchOutput()
+		go e.watchIdle()
 	}
 
+	if e.file == nil {
+		go e.writeCommands(command...)
+	}
+
+	go e.wait()
+	return nil
+}
+
+// writeCommands writes the commands to stdin of the started shell,
+// it blocks until the shell reads them if they are larger than the pipe buffer.
+func (e *Exec) writeCommands(command ...string) {
+	err := e.addCommands(command...)
+	// the shell exits after reading all commands from stdin,
+	// the shell of a session keeps reading the next batch
+	if err == nil && e.session == nil {
+		err = e.stdin.Close()
+	}
+	// the shell may exit before reading all commands, then its exit status is reported,
+	// stdin is closed when it finishes
+	if err != nil && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, os.ErrClosed) {
+		e.setErr(err, true)
+		e.stop()
+	}
+}
+
+func (e *Exec) addCommands(command ...string) error {
+	// it is written as it is, the line numbers are the same as the failed attempt
+	if err := e.writeRaw(e.replay); err != nil {
+		return err
+	}
+	e.replay = nil
 	for _, s := range command {
-		if err = e.AddCommand(s); err != nil {
+		if err := e.writeRaw(commandRaw(s)); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if err = e.addFinishedRawCommand(); err != nil {
-		return err
+func (e *Exec) wait() {
+	defer e.closeDone()
+	defer e.setFinished()
+
+	waitErr := e.cmd.Wait()
+	exitTime := time.Now()
+	// stop the background processes that are still alive
+	e.stopProcessGroup()
+	e.waitOutput()
+	e.buildProfile(exitTime)
+	e.buildCoverage()
+	e.readCapture()
+	e.removeStateDir()
+	if waitErr != nil {
+		e.setErr(e.exitError(waitErr), true)
 	}
+	result := e.buildResult(time.Now())
 
-	go func() {
-		scanner := bufio.NewScanner(e.stdout)
-		var num int
-		for scanner.Scan() {
-			num++
-			if !e.parseOutput(num, scanner.Bytes()) {
-				break
-			}
-		}
-		if scanner.Err() != nil {
-			e.setErr(fmt.Errorf("read: %s", scanner.Err()), false)
-		}
-	}()
+	e.mu.Lock()
+	e.result = result
+	e.mu.Unlock()
+}
 
-	if err = e.cmd.Wait(); err != nil {
-		e.setErr(err, true)
+// Wait waits for the started execution to finish and returns its error.
+func (e *Exec) Wait() error {
+	e.mu.Lock()
+	pending := !e.started && !e.finished
+	e.mu.Unlock()
+	if pending {
+		return ErrNotStarted
 	}
+
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.err
 }
 
-type ExecError struct {
-	ID      string
-	Context context.Context
-	Err     error
+// Done returns a channel that is closed when the execution is finished
+// and all output is delivered.
+func (e *Exec) Done() <-chan struct{} {
+	return e.done
+}
+
+func (e *Exec) closeDone() {
+	e.doneOnce.Do(func() {
+		close(e.done)
+	})
 }
 
-func (e *ExecError) Error() string {
-	if e.Context != nil && e.Context.Err() != nil {
-		return e.Context.Err().Error()
+// waitOutput waits until all output is read and delivered.
+// The pipes are closed if they are held by processes out of the process group
+// and no output is read for outputWaitDelay.
+func (e *Exec) waitOutput() {
+	done := make(chan struct{})
+	go func() {
+		e.readers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(outputWaitDelay)
+	defer timer.Stop()
+	reads := e.reads.Load()
+	for {
+		select {
+		case <-done:
+			e.closeOutput()
+			return
+		case <-timer.C:
+			if n := e.reads.Load(); n != reads {
+				reads = n
+				timer.Reset(outputWaitDelay)
+				continue
+			}
+			e.closeOutput()
+			<-done
+			return
+		}
 	}
-	return e.Err.Error()
 }
 
-func IsDeadlineExceeded(err error) bool {
-	return err.Error() == context.DeadlineExceeded.Error()
+func (e *Exec) closeOutput() {
+	_ = e.stdout.Close()
+	if e.stderr != nil {
+		_ = e.stderr.Close()
+	}
+	_ = e.control.Close()
+}
+
+func (e *Exec) setErrReport(val string) {
+	r, err := parseErrReport(e.secrets.mask(val))
+	if err != nil {
+		return
+	}
+	mainSource := ""
+	if e.file != nil {
+		mainSource = e.file.Name()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r.trimLines(e.startLines, mainSource)
+	e.trimStep(r)
+	// a failing function reports again in its caller, keep the innermost one
+	if prev := e.errReport; prev != nil && prev.code == r.code && len(r.stack) < len(prev.stack) {
+		return
+	}
+	e.errReport = r
 }
@@ -2,9 +2,16 @@ package sh
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/zdz1715/go-sh/shell"
 )
 
 func TestExec_Run(t *testing.T) {
@@ -85,3 +92,247 @@ func TestExec_Cancel(t *testing.T) {
 	}
 	t.Logf("finished: %+v lastWorkDir: %s\n", e.finished, e.GetLastWorkDir())
 }
+
+func TestExec_RunSeparateStderr(t *testing.T) {
+	got := make(map[Stream][]string)
+	e, err := NewExec(&ExecOptions{
+		SeparateStderr: true,
+		StreamOutput: func(stream Stream, num int, line []byte) {
+			got[stream] = append(got[stream], string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("echo data", "echo warning >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("stdout: %q stderr: %q", got[Stdout], got[Stderr])
+	if len(got[Stdout]) != 1 || got[Stdout][0] != "data" {
+		t.Errorf("stdout: %q", got[Stdout])
+	}
+	if len(got[Stderr]) != 3 || got[Stderr][2] != "warning" {
+		t.Errorf("stderr: %q", got[Stderr])
+	}
+}
+
+func TestExec_Result(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		WorkDir: "/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Result() != nil {
+		t.Error("result is not nil before run")
+	}
+	_ = e.Run("cd /tmp", "echo hello world")
+	r := e.Result()
+	t.Logf("result: %+v", r)
+	if !r.Success() || r.PID == 0 || r.LastWorkDir != "/tmp" || r.Lines != 3 || r.Duration <= 0 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	e, err = NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = e.Run("exit 3")
+	if r = e.Result(); r.ExitCode != 3 || r.Success() {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	e, err = NewExecContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = e.Run("sleep 10")
+	if r = e.Result(); !r.TimedOut || r.Signal == 0 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+}
+
+func TestExec_LastWorkDirOnExit(t *testing.T) {
+	tests := map[string]string{
+		"exit 3":    "/tmp",
+		"false":     "/tmp",
+		"echo done": "/usr",
+	}
+	for command, want := range tests {
+		e, err := NewExec(&ExecOptions{
+			WorkDir: "/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run("cd /tmp", command, "cd /usr")
+		t.Logf("%s: %v", command, err)
+		if dir := e.GetLastWorkDir(); dir != want {
+			t.Errorf("%s: last work dir: %q, want %q", command, dir, want)
+		}
+	}
+}
+
+func TestExec_LineNumbers(t *testing.T) {
+	tests := []struct {
+		shell *shell.Shell
+		want  string
+	}{
+		{&shell.Shell{Type: shell.Bash, Set: shell.NoUnset}, "line 2: UNDEF: unbound variable"},
+		{&shell.Shell{Type: shell.Bash, Set: shell.NoUnset | shell.Posix}, "line 2: UNDEF: unbound variable"},
+		{&shell.Shell{Type: shell.Sh, Set: shell.NoUnset}, ": 2: UNDEF: parameter not set"},
+	}
+	for _, tt := range tests {
+		for _, storage := range []*Storage{nil, {Dir: t.TempDir()}} {
+			var lines []string
+			e, err := NewExec(&ExecOptions{
+				Shell:   tt.shell,
+				Storage: storage,
+				Output: func(num int, line []byte) {
+					lines = append(lines, string(line))
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = e.Run("cd /tmp", "echo $UNDEF")
+			if len(lines) != 1 || !strings.HasSuffix(lines[0], tt.want) {
+				t.Errorf("%s: lines: %q", tt.shell, lines)
+			}
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) {
+				t.Errorf("%s: %v is not ExitError", tt.shell, err)
+			}
+		}
+	}
+
+	// LINENO of the trap set by the script
+	var lines []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {
+			lines = append(lines, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run(`trap 'echo "err $LINENO"' ERR`, "false", "echo $BASH_ENV"); err != nil {
+		t.Fatal(err)
+	}
+	// BASH_ENV is not inherited by the shells run by the script
+	if strings.Join(lines, "\n") != "err 2\n" {
+		t.Errorf("lines: %q", lines)
+	}
+}
+
+func TestExec_BashEnv(t *testing.T) {
+	env := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(env, []byte("greet() { echo \"hello $1\"; }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Env:   map[string]string{"BASH_ENV": env},
+		Output: func(num int, line []byte) {
+			lines = append(lines, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file of BASH_ENV is read by the shell and the shells run by the script
+	if err = e.Run("greet a", `bash -c 'greet b'`, `echo "$BASH_ENV"`); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "\n") != "hello a\nhello b\n"+env {
+		t.Errorf("lines: %q", lines)
+	}
+}
+
+func TestExec_RunDeliversAllOutput(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		var lines int
+		last := make(map[Stream]string)
+		e, err := NewExec(&ExecOptions{
+			SeparateStderr: separate,
+			Shell:          &shell.Shell{Type: shell.Bash},
+			StreamOutput: func(stream Stream, num int, line []byte) {
+				lines++
+				last[stream] = string(line)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run("seq 1 10000", "echo last error line >&2", "exit 1")
+		want := map[Stream]string{Stdout: "last error line"}
+		if separate {
+			want = map[Stream]string{Stdout: "10000", Stderr: "last error line"}
+		}
+		if lines != 10001 || len(last) != len(want) || last[Stdout] != want[Stdout] || last[Stderr] != want[Stderr] {
+			t.Errorf("separate stderr %v: %d lines, last lines %q, err: %v", separate, lines, last, err)
+		}
+	}
+}
+
+func TestExec_RunWithDetachedProcess(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		SeparateStderr: true,
+		Output:         func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	// the detached process is out of the process group and holds stderr
+	if err = e.Run("(setsid sleep 5 &)", "echo done"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= 5*time.Second {
+		t.Errorf("run waits for the detached process: %s", d)
+	}
+}
+
+func TestExec_Concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		e, err := NewExec(&ExecOptions{
+			SeparateStderr: i%2 == 0,
+			Output:         func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			err := e.Run("for i in $(seq 1 50); do echo $i; echo $i >&2; done", "cd /tmp", "sleep 0.2")
+			// canceled before running
+			if errors.Is(err, ErrFinished) {
+				return
+			}
+			if !e.Finished() || e.Result() == nil {
+				t.Errorf("%s is not finished after run: %v", e.ID(), err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for !e.Finished() {
+				_ = e.GetLastWorkDir()
+				_ = e.Result()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		go func(delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			_ = e.Cancel()
+		}(time.Duration(i*15) * time.Millisecond)
+	}
+	wg.Wait()
+}
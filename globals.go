@@ -3,6 +3,7 @@ package sh
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/zdz1715/go-sh/shell"
 )
@@ -38,6 +39,27 @@ func SetGlobalExecUser(user string) {
 	gExecOptions.User = user
 }
 
+// SetGlobalExecEnv Sets the environment variables for execution globally.
+// The variables set separately are merged with them,
+// and the same key will not be overwritten.
+func SetGlobalExecEnv(env map[string]string) {
+	gExecOptions.Env = env
+}
+
+// AddGlobalExecSecret Adds the secrets to be masked for execution globally.
+// The secrets set separately are merged with them.
+func AddGlobalExecSecret(secrets ...string) {
+	gExecOptions.Secrets = append(gExecOptions.Secrets, secrets...)
+}
+
+// SetGlobalExecEnvMode Sets the environment mode for execution globally.
+// If the mode has been set separately,
+// it will not be overwritten.
+func SetGlobalExecEnvMode(mode EnvMode, allowlist ...string) {
+	gExecOptions.EnvMode = mode
+	gExecOptions.EnvAllowlist = allowlist
+}
+
 // SetGlobalExecOutput Sets the output func for execution globally.
 // If the output func has been set separately,
 // it will not be overwritten.
@@ -45,6 +67,34 @@ func SetGlobalExecOutput(f func(num int, line []byte)) {
 	gExecOptions.Output = f
 }
 
+// SetGlobalExecStreamOutput Sets the stream output func for execution globally.
+// If the stream output func has been set separately,
+// it will not be overwritten.
+func SetGlobalExecStreamOutput(f func(stream Stream, num int, line []byte)) {
+	gExecOptions.StreamOutput = f
+}
+
+// SetGlobalExecOutputHandler Sets the output handler for execution globally.
+// If any output has been set separately,
+// it will not be overwritten.
+func SetGlobalExecOutputHandler(h OutputHandler) {
+	gExecOptions.OutputHandler = h
+}
+
+// SetGlobalStopPolicy Sets the stop policy for execution globally.
+// If the stop policy has been set separately,
+// it will not be overwritten.
+func SetGlobalStopPolicy(policy *StopPolicy) {
+	gExecOptions.Stop = policy
+}
+
+// SetGlobalIdleTimeout Sets the idle timeout for execution globally.
+// If the idle timeout has been set separately,
+// it will not be overwritten.
+func SetGlobalIdleTimeout(timeout time.Duration) {
+	gExecOptions.IdleTimeout = timeout
+}
+
 // SetGlobalStorage Sets the storage for execution globally.
 // If the storage has been set separately,
 // it will not be overwritten.
@@ -0,0 +1,41 @@
+package sh
+
+import "time"
+
+// touchOutput records the time of the last output
+func (e *Exec) touchOutput() {
+	e.lastOutput.Store(time.Now().UnixNano())
+}
+
+// watchIdle stops the process group by the stop policy if no output arrives for ExecOptions.IdleTimeout,
+// the shell of a session is only watched while a batch is running.
+func (e *Exec) watchIdle() {
+	idle := e.opts.IdleTimeout
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-e.exited:
+			return
+		}
+		if e.session != nil && !e.session.running() {
+			e.touchOutput()
+		}
+		if d := time.Since(time.Unix(0, e.lastOutput.Load())); d < idle {
+			timer.Reset(idle - d)
+			continue
+		}
+
+		e.mu.Lock()
+		stopped := e.finished || e.canceled
+		if !stopped {
+			e.idleTimedOut = true
+		}
+		e.mu.Unlock()
+		if !stopped {
+			e.stop()
+		}
+		return
+	}
+}
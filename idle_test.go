@@ -0,0 +1,79 @@
+package sh
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_IdleTimeout(t *testing.T) {
+	var lines []string
+	e, err := NewExec(&ExecOptions{
+		Shell:       &shell.Shell{Type: shell.Bash},
+		IdleTimeout: 300 * time.Millisecond,
+		Output: func(num int, line []byte) {
+			lines = append(lines, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	// the output keeps it alive until the prompt waiting for an answer
+	err = e.Run("for i in 1 2 3 4 5; do echo $i; sleep 0.1; done", "printf 'continue? [y/N] '; sleep 10")
+	if !errors.Is(err, ErrIdleTimeout) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		t.Errorf("err: %v", err)
+	}
+	if d := time.Since(start); d < 600*time.Millisecond || d > 5*time.Second {
+		t.Errorf("stopped after %s", d)
+	}
+	if r := e.Result(); !r.IdleTimedOut || r.TimedOut || r.Canceled {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if s := e.State(); s != StateTimedOut {
+		t.Errorf("state: %s", s)
+	}
+	if len(lines) != 6 || lines[5] != "continue? [y/N] " {
+		t.Errorf("lines: %q", lines)
+	}
+}
+
+func TestExec_IdleTimeoutNotReached(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		IdleTimeout: 500 * time.Millisecond,
+		Output:      func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("for i in 1 2 3 4 5 6; do echo $i; sleep 0.2; done"); err != nil {
+		t.Fatal(err)
+	}
+	if r := e.Result(); r.IdleTimedOut {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if s := e.State(); s != StateSucceeded {
+		t.Errorf("state: %s", s)
+	}
+}
+
+func TestSession_IdleTimeout(t *testing.T) {
+	s, err := NewSession(&ExecOptions{
+		IdleTimeout: 300 * time.Millisecond,
+		Output:      func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the session is not stopped between the batches
+	time.Sleep(500 * time.Millisecond)
+	if _, err = s.Run("echo ok"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Run("sleep 10"); !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("err: %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package sh
 
-import "github.com/zdz1715/go-sh/shell"
+import (
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
 
 type ExecOptions struct {
 	IDCreator IDCreator
@@ -8,17 +12,74 @@ type ExecOptions struct {
 	Storage   *Storage
 	User      string
 	WorkDir   string
-	Output    func(num int, line []byte)
+	// Env is set on top of the environment selected by EnvMode,
+	// the keys are merged with the global ones.
+	Env          map[string]string
+	EnvMode      EnvMode
+	EnvAllowlist []string
+	Output       func(num int, line []byte)
+	// SeparateStderr reads stderr separately instead of redirecting it to stdout.
+	SeparateStderr bool
+	// StreamOutput receives every line with its stream, Output is not called when it is set.
+	StreamOutput func(stream Stream, num int, line []byte)
+	// OutputHandler receives every line with its metadata,
+	// Output and StreamOutput are not called when it is set.
+	OutputHandler OutputHandler
+	// CommandHandler receives the commands traced by set -x with their line numbers and functions,
+	// they are not delivered to the output when it is set.
+	// It is only supported by bash and not called if ChunkOutput is set.
+	CommandHandler func(event CommandEvent)
+	// Profile measures the time spent on every line and function of the script, see Exec.Profile.
+	// It enables xtrace and is only supported by bash.
+	Profile bool
+	// Coverage records the lines and functions of the script and the files sourced by it that ran,
+	// see Exec.Coverage. It enables xtrace and is only supported by bash.
+	Coverage bool
+	// MaxLineSize splits the lines longer than it, the line length is not limited if it is 0.
+	MaxLineSize int
+	// ChunkOutput receives the raw output in chunks instead of lines, such as binary output,
+	// Output and StreamOutput are not called when it is set. The chunk is only valid during the call.
+	ChunkOutput func(stream Stream, chunk []byte)
+	// Stop is the policy to stop the process group when canceled or the context is done,
+	// it is KillStopPolicy if nil.
+	Stop *StopPolicy
+	// IdleTimeout stops the process group by Stop if no output line or chunk arrives on any stream for it,
+	// such as a command waiting for an unexpected prompt. The error matches ErrIdleTimeout.
+	// The shell of a session is only watched while a batch is running.
+	IdleTimeout time.Duration
+	// Secrets are replaced with SecretMask in the output, error messages and stored scripts,
+	// including their base64 and URL-encoded variants. They are merged with the global ones.
+	Secrets []string
+	// CaptureEnv captures the exported environment when the shell exits, see Exec.GetLastEnv.
+	CaptureEnv bool
+	// CaptureVars captures the variables when the shell exits, exported or not, see Exec.GetVar.
+	CaptureVars []string
 }
 
 func (e *ExecOptions) Copy() *ExecOptions {
 	return &ExecOptions{
-		IDCreator: e.IDCreator,
-		Shell:     e.Shell,
-		Storage:   e.Storage,
-		User:      e.User,
-		WorkDir:   e.WorkDir,
-		Output:    e.Output,
+		IDCreator:      e.IDCreator,
+		Shell:          e.Shell,
+		Storage:        e.Storage,
+		User:           e.User,
+		WorkDir:        e.WorkDir,
+		Env:            e.Env,
+		EnvMode:        e.EnvMode,
+		EnvAllowlist:   e.EnvAllowlist,
+		Output:         e.Output,
+		SeparateStderr: e.SeparateStderr,
+		StreamOutput:   e.StreamOutput,
+		OutputHandler:  e.OutputHandler,
+		CommandHandler: e.CommandHandler,
+		Profile:        e.Profile,
+		Coverage:       e.Coverage,
+		MaxLineSize:    e.MaxLineSize,
+		ChunkOutput:    e.ChunkOutput,
+		Stop:           e.Stop,
+		IdleTimeout:    e.IdleTimeout,
+		Secrets:        e.Secrets,
+		CaptureEnv:     e.CaptureEnv,
+		CaptureVars:    e.CaptureVars,
 	}
 }
 
@@ -43,9 +104,47 @@ func GlobalExecOptionsOverwrite(opts ...*ExecOptions) *ExecOptions {
 		if eCopy.WorkDir == "" {
 			eCopy.WorkDir = gExecOptions.WorkDir
 		}
+		if len(gExecOptions.Env) > 0 {
+			env := make(map[string]string, len(gExecOptions.Env)+len(eCopy.Env))
+			for k, v := range gExecOptions.Env {
+				env[k] = v
+			}
+			for k, v := range eCopy.Env {
+				env[k] = v
+			}
+			eCopy.Env = env
+		}
+		if len(gExecOptions.Secrets) > 0 {
+			secrets := make([]string, 0, len(gExecOptions.Secrets)+len(eCopy.Secrets))
+			secrets = append(secrets, gExecOptions.Secrets...)
+			eCopy.Secrets = append(secrets, eCopy.Secrets...)
+		}
+		if eCopy.EnvMode == EnvDefault {
+			eCopy.EnvMode = gExecOptions.EnvMode
+		}
+		if eCopy.EnvAllowlist == nil {
+			eCopy.EnvAllowlist = gExecOptions.EnvAllowlist
+		}
+		// the global handler is only used if no output is set separately
+		if eCopy.OutputHandler == nil && eCopy.Output == nil && eCopy.StreamOutput == nil {
+			eCopy.OutputHandler = gExecOptions.OutputHandler
+		}
+		// the global stream output is preferred to Output, it is not used if Output is set separately
+		if eCopy.StreamOutput == nil && eCopy.Output == nil && eCopy.OutputHandler == nil {
+			eCopy.StreamOutput = gExecOptions.StreamOutput
+		}
 		if eCopy.Output == nil {
 			eCopy.Output = gExecOptions.Output
 		}
+		if eCopy.MaxLineSize == 0 {
+			eCopy.MaxLineSize = gExecOptions.MaxLineSize
+		}
+		if eCopy.Stop == nil {
+			eCopy.Stop = gExecOptions.Stop
+		}
+		if eCopy.IdleTimeout == 0 {
+			eCopy.IdleTimeout = gExecOptions.IdleTimeout
+		}
 	}
 	return eCopy
 }
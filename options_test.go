@@ -13,3 +13,58 @@ func TestGlobalExecOptionsOverwrite(t *testing.T) {
 		Shell: &shell.Shell{},
 	}))
 }
+
+func TestGlobalExecOptionsOverwrite_Env(t *testing.T) {
+	defer SetGlobalExecEnv(nil)
+	SetGlobalExecEnv(map[string]string{
+		"LANG": "en_US.UTF-8",
+		"TZ":   "Asia/Shanghai",
+	})
+	opts := GlobalExecOptionsOverwrite(&ExecOptions{
+		Env: map[string]string{
+			"TZ": "UTC",
+		},
+	})
+	if opts.Env["LANG"] != "en_US.UTF-8" || opts.Env["TZ"] != "UTC" {
+		t.Errorf("env: %v", opts.Env)
+	}
+}
+
+func TestGlobalExecOptionsOverwrite_EnvMode(t *testing.T) {
+	defer SetGlobalExecEnvMode(EnvDefault)
+	SetGlobalExecEnvMode(EnvClean)
+	if opts := GlobalExecOptionsOverwrite(&ExecOptions{}); opts.EnvMode != EnvClean {
+		t.Errorf("default: %s", opts.EnvMode)
+	}
+	// an exec can opt back into inheriting the environment
+	if opts := GlobalExecOptionsOverwrite(&ExecOptions{EnvMode: EnvInherit}); opts.EnvMode != EnvInherit {
+		t.Errorf("inherit: %s", opts.EnvMode)
+	}
+}
+
+func TestGlobalExecOptionsOverwrite_StreamOutput(t *testing.T) {
+	defer SetGlobalExecStreamOutput(nil)
+	var global, own []string
+	SetGlobalExecStreamOutput(func(stream Stream, num int, line []byte) {
+		global = append(global, string(line))
+	})
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {
+			own = append(own, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo ok"); err != nil {
+		t.Fatal(err)
+	}
+	if len(own) != 1 || own[0] != "ok" || len(global) != 0 {
+		t.Errorf("output: %q, global stream output: %q", own, global)
+	}
+	// it is still used without any output set
+	if opts := GlobalExecOptionsOverwrite(&ExecOptions{}); opts.StreamOutput == nil {
+		t.Error("global stream output is not used")
+	}
+}
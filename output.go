@@ -0,0 +1,143 @@
+package sh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Stream identifies the output stream of a line.
+type Stream uint8
+
+const (
+	Stdout Stream = iota + 1
+	Stderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// Line is an output line with its metadata.
+type Line struct {
+	ExecID string
+	Stream Stream
+	// Num is the line number in the output of the execution, starting from 1
+	Num  int
+	Time time.Time
+	// Elapsed is the time since the execution started
+	Elapsed time.Duration
+	// XTrace reports whether the line is a command traced by set -x
+	XTrace bool
+	// Data is the line without the line ending, it is owned by the receiver
+	Data []byte
+}
+
+func (l Line) String() string {
+	return string(l.Data)
+}
+
+// OutputHandler receives the output lines of an execution,
+// the lines of stdout and stderr are received one at a time.
+type OutputHandler interface {
+	HandleLine(line Line)
+}
+
+// OutputFunc adapts the func of ExecOptions.Output to OutputHandler.
+type OutputFunc func(num int, line []byte)
+
+func (f OutputFunc) HandleLine(line Line) {
+	f(line.Num, line.Data)
+}
+
+// StreamOutputFunc adapts the func of ExecOptions.StreamOutput to OutputHandler.
+type StreamOutputFunc func(stream Stream, num int, line []byte)
+
+func (f StreamOutputFunc) HandleLine(line Line) {
+	f(line.Stream, line.Num, line.Data)
+}
+
+// outputHandler returns the handler of the output lines,
+// OutputHandler is preferred to StreamOutput, and StreamOutput is preferred to Output.
+func (e *ExecOptions) outputHandler() OutputHandler {
+	switch {
+	case e.OutputHandler != nil:
+		return e.OutputHandler
+	case e.StreamOutput != nil:
+		return StreamOutputFunc(e.StreamOutput)
+	case e.Output != nil:
+		return OutputFunc(e.Output)
+	}
+	return nil
+}
+
+// chunkSize is the buffer size of reading the output
+const chunkSize = 32 * 1024
+
+// readLines calls fn with every line read from r without the line ending until fn returns false,
+// the lines longer than max are split, there is no limit if max <= 0.
+// The line passed to fn is only valid during the call.
+func readLines(r io.Reader, max int, fn func(line []byte) bool) error {
+	reader := bufio.NewReaderSize(r, chunkSize)
+	var long []byte // the line longer than the buffer
+	for {
+		b, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			long = append(long, b...)
+			for max > 0 && len(long) > max {
+				if !fn(long[:max]) {
+					return nil
+				}
+				long = append(long[:0], long[max:]...)
+			}
+			continue
+		}
+		if long != nil {
+			b = append(long, b...)
+			long = nil
+		}
+		// the last line may not end with '\n'
+		if err == nil || len(b) > 0 {
+			b = dropEOL(b)
+			for max > 0 && len(b) > max {
+				if !fn(b[:max]) {
+					return nil
+				}
+				b = b[max:]
+			}
+			if !fn(b) {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func dropEOL(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte{'\n'})
+	return bytes.TrimSuffix(b, []byte{'\r'})
+}
+
+// readChunks calls fn with every chunk read from r, the chunk is only valid during the call.
+func readChunks(r io.Reader, fn func(chunk []byte)) error {
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fn(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
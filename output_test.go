@@ -0,0 +1,136 @@
+package sh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		input string
+		max   int
+		want  []string
+	}{
+		{input: "a\nb\r\n\nc", want: []string{"a", "b", "", "c"}},
+		{input: "abcdefg\nhi\n", max: 3, want: []string{"abc", "def", "g", "hi"}},
+		{input: "abc\n", max: 3, want: []string{"abc"}},
+		{input: strings.Repeat("x", chunkSize*3) + "\nend", want: []string{strings.Repeat("x", chunkSize*3), "end"}},
+		{input: strings.Repeat("x", chunkSize*2+1) + "\n", max: chunkSize, want: []string{
+			strings.Repeat("x", chunkSize), strings.Repeat("x", chunkSize), "x",
+		}},
+	}
+	for _, tt := range tests {
+		var lines []string
+		err := readLines(strings.NewReader(tt.input), tt.max, func(line []byte) bool {
+			lines = append(lines, string(line))
+			return true
+		})
+		if err == nil {
+			t.Error("EOF is not returned")
+		}
+		if strings.Join(lines, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("max: %d, lines: %d, want: %d", tt.max, len(lines), len(tt.want))
+		}
+	}
+}
+
+func TestExec_RunLongLine(t *testing.T) {
+	var lines []int
+	e, err := NewExec(&ExecOptions{
+		Output: func(num int, line []byte) {
+			lines = append(lines, len(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("set +x", "head -c 1000000 /dev/zero | tr '\\0' x; echo", "cd /tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first line is "+ set +x"
+	if len(lines) != 2 || lines[1] != 1000000 || e.GetLastWorkDir() != "/tmp" {
+		t.Errorf("lines: %v, last work dir: %s", lines, e.GetLastWorkDir())
+	}
+}
+
+func TestExec_RunChunkOutput(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e, err := NewExec(&ExecOptions{
+		ChunkOutput: func(stream Stream, chunk []byte) {
+			if stream != Stdout {
+				t.Errorf("stream: %s", stream)
+			}
+			buf.Write(chunk)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("set +x", `printf 'a\000b\nc'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "+ set +x\na\x00b\nc" || e.Result().Bytes != 14 {
+		t.Errorf("output: %q, result: %+v", buf.String(), e.Result())
+	}
+}
+
+type lineRecorder struct {
+	lines []Line
+}
+
+func (r *lineRecorder) HandleLine(line Line) {
+	r.lines = append(r.lines, line)
+}
+
+func TestExec_RunOutputHandler(t *testing.T) {
+	r := &lineRecorder{}
+	e, err := NewExec(&ExecOptions{
+		OutputHandler: r,
+		// not called when OutputHandler is set
+		Output: func(num int, line []byte) {
+			t.Errorf("output is called: %s", line)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo hello", "echo world >&2"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		data   string
+		xtrace bool
+	}{
+		{"+ echo hello", true},
+		{"hello", false},
+		{"+ echo world", true},
+		{"world", false},
+	}
+	if len(r.lines) != len(want) {
+		t.Fatalf("lines: %v", r.lines)
+	}
+	for i, line := range r.lines {
+		if line.ExecID != e.ID() || line.Num != i+1 || line.Stream != Stdout || line.Time.IsZero() || line.Elapsed <= 0 {
+			t.Errorf("line %d: %+v", i, line)
+		}
+		if line.String() != want[i].data || line.XTrace != want[i].xtrace {
+			t.Errorf("line %d: %q, xtrace: %t", i, line.Data, line.XTrace)
+		}
+	}
+}
+
+func TestOutputFunc(t *testing.T) {
+	var lines []string
+	var h OutputHandler = OutputFunc(func(num int, line []byte) {
+		lines = append(lines, fmt.Sprintf("%d:%s", num, line))
+	})
+	h.HandleLine(Line{Num: 3, Data: []byte("hello")})
+	if len(lines) != 1 || lines[0] != "3:hello" {
+		t.Errorf("lines: %q", lines)
+	}
+}
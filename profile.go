@@ -0,0 +1,238 @@
+package sh
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Profile is the wall time spent on the lines and functions of a script,
+// the time between two traced commands is spent on the former one.
+type Profile struct {
+	// Total is the time from the first traced command to the exit of the shell
+	Total time.Duration
+	// Lines is sorted by the time spent, the longest first
+	Lines []LineProfile
+	// Functions is sorted by the time spent, the longest first
+	Functions []FunctionProfile
+
+	folded map[string]time.Duration
+}
+
+// LineProfile is the time spent on a line of the script.
+type LineProfile struct {
+	Line int
+	// Source is the file sourced by the script, empty in the script itself
+	Source   string
+	Function string
+	// Command is the first command traced on the line
+	Command  string
+	Count    int
+	Duration time.Duration
+}
+
+// FunctionProfile is the time spent on a function.
+type FunctionProfile struct {
+	Function string
+	// Self is the time spent on the commands of the function itself,
+	// Duration includes the functions called by it.
+	Self     time.Duration
+	Duration time.Duration
+}
+
+// foldedReplacer replaces ';' separating the frames of the folded stacks
+var foldedReplacer = strings.NewReplacer(";", ",", "\n", " ")
+
+type lineKey struct {
+	line     int
+	source   string
+	function string
+}
+
+// profiler aggregates the time of the traced commands
+type profiler struct {
+	first time.Time
+	last  *CommandEvent
+
+	lines     map[lineKey]*LineProfile
+	functions map[string]*FunctionProfile
+	folded    map[string]time.Duration
+}
+
+func newProfiler() *profiler {
+	return &profiler{
+		lines:     make(map[lineKey]*LineProfile),
+		functions: make(map[string]*FunctionProfile),
+		folded:    make(map[string]time.Duration),
+	}
+}
+
+func (p *profiler) add(event CommandEvent) {
+	if event.Time.IsZero() {
+		return
+	}
+	if p.last == nil {
+		p.first = event.Time
+	} else {
+		p.spend(event.Time)
+	}
+	p.last = &event
+}
+
+// spend adds the time until end to the last command
+func (p *profiler) spend(end time.Time) {
+	last := p.last
+	if last == nil {
+		return
+	}
+	d := end.Sub(last.Time)
+	if d < 0 {
+		d = 0
+	}
+
+	key := lineKey{line: last.Line, source: last.Source, function: last.Function}
+	l, ok := p.lines[key]
+	if !ok {
+		l = &LineProfile{Line: last.Line, Source: last.Source, Function: last.Function, Command: last.Command}
+		p.lines[key] = l
+	}
+	l.Count++
+	l.Duration += d
+
+	seen := make(map[string]bool, len(last.Stack))
+	for i, name := range last.Stack {
+		f, ok := p.functions[name]
+		if !ok {
+			f = &FunctionProfile{Function: name}
+			p.functions[name] = f
+		}
+		if i == 0 {
+			f.Self += d
+		}
+		// the recursive calls are counted once
+		if !seen[name] {
+			f.Duration += d
+			seen[name] = true
+		}
+	}
+
+	frames := make([]string, 0, len(last.Stack)+2)
+	frames = append(frames, "main")
+	for i := len(last.Stack) - 1; i >= 0; i-- {
+		frames = append(frames, last.Stack[i])
+	}
+	if last.Source != "" {
+		frames = append(frames, fmt.Sprintf("%s: line %d: %s", last.Source, last.Line, last.Command))
+	} else {
+		frames = append(frames, fmt.Sprintf("line %d: %s", last.Line, last.Command))
+	}
+	for i := range frames {
+		frames[i] = foldedReplacer.Replace(frames[i])
+	}
+	p.folded[strings.Join(frames, ";")] += d
+}
+
+// profile returns the profile with the last command ended at end
+func (p *profiler) profile(end time.Time) *Profile {
+	p.spend(end)
+	p.last = nil
+
+	r := &Profile{
+		folded: p.folded,
+	}
+	if !p.first.IsZero() {
+		r.Total = end.Sub(p.first)
+	}
+	for _, l := range p.lines {
+		r.Lines = append(r.Lines, *l)
+	}
+	sort.Slice(r.Lines, func(i, j int) bool {
+		if r.Lines[i].Duration != r.Lines[j].Duration {
+			return r.Lines[i].Duration > r.Lines[j].Duration
+		}
+		if r.Lines[i].Source != r.Lines[j].Source {
+			return r.Lines[i].Source < r.Lines[j].Source
+		}
+		return r.Lines[i].Line < r.Lines[j].Line
+	})
+	for _, f := range p.functions {
+		r.Functions = append(r.Functions, *f)
+	}
+	sort.Slice(r.Functions, func(i, j int) bool {
+		if r.Functions[i].Duration != r.Functions[j].Duration {
+			return r.Functions[i].Duration > r.Functions[j].Duration
+		}
+		return r.Functions[i].Function < r.Functions[j].Function
+	})
+	return r
+}
+
+// WriteReport writes the lines and functions sorted by the time spent.
+func (p *Profile) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TOTAL\t%s\n\n", p.Total)
+	fmt.Fprintln(tw, "LINE\tFUNCTION\tCOUNT\tTIME\t%\tCOMMAND")
+	for _, l := range p.Lines {
+		line := strconv.Itoa(l.Line)
+		if l.Source != "" {
+			line = l.Source + ":" + line
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%.1f\t%s\n",
+			line, l.Function, l.Count, l.Duration, p.percent(l.Duration), l.Command)
+	}
+	if len(p.Functions) > 0 {
+		fmt.Fprintln(tw, "\nFUNCTION\tSELF\tTIME\t%")
+		for _, f := range p.Functions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\n", f.Function, f.Self, f.Duration, p.percent(f.Duration))
+		}
+	}
+	return tw.Flush()
+}
+
+func (p *Profile) percent(d time.Duration) float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return float64(d) / float64(p.Total) * 100
+}
+
+// WriteFolded writes the folded stacks with the time in microseconds,
+// it can be read by flamegraph tools, such as flamegraph.pl and speedscope.
+func (p *Profile) WriteFolded(w io.Writer) error {
+	stacks := make([]string, 0, len(p.folded))
+	for stack := range p.folded {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, p.folded[stack].Microseconds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exec) buildProfile(exitTime time.Time) {
+	if e.profiler == nil {
+		return
+	}
+	e.outputMu.Lock()
+	p := e.profiler.profile(exitTime)
+	e.outputMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.profile = p
+}
+
+// Profile returns the profile of the script when ExecOptions.Profile is set,
+// it is nil if it has not finished running.
+func (e *Exec) Profile() *Profile {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.profile
+}
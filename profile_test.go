@@ -0,0 +1,61 @@
+package sh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_RunProfile(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell:   &shell.Shell{Type: shell.Bash, Set: shell.ErrExit},
+		Profile: true,
+		Output:  func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run(
+		"slow() {\n  sleep 0.2\n}",
+		"deploy() {\n  slow\n  echo deployed\n}",
+		"deploy",
+		"sleep 0.1",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := e.Profile()
+	if p == nil || len(p.Lines) == 0 {
+		t.Fatalf("profile: %+v", p)
+	}
+	if l := p.Lines[0]; l.Line != 2 || l.Function != "slow" || l.Command != "sleep 0.2" || l.Duration < 200*time.Millisecond {
+		t.Errorf("slowest line: %+v", l)
+	}
+	if l := p.Lines[1]; l.Line != 9 || l.Function != "" || l.Duration < 100*time.Millisecond {
+		t.Errorf("second line: %+v", l)
+	}
+	if f := p.Functions[0]; f.Function != "deploy" || f.Duration < 200*time.Millisecond || f.Self >= f.Duration {
+		t.Errorf("function: %+v", f)
+	}
+	if p.Total < 300*time.Millisecond {
+		t.Errorf("total: %s", p.Total)
+	}
+
+	report := new(bytes.Buffer)
+	if err = p.WriteReport(report); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("report:\n%s", report)
+
+	folded := new(bytes.Buffer)
+	if err = p.WriteFolded(folded); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(folded.String(), "main;deploy;slow;line 2: sleep 0.2 2") {
+		t.Errorf("folded:\n%s", folded)
+	}
+}
@@ -0,0 +1,76 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// ExecResult is the summary of a finished execution.
+type ExecResult struct {
+	ID string
+	// ExitCode is the exit code of the shell, or -1 if it was terminated by a signal
+	ExitCode int
+	// Signal is the signal that terminated the shell, 0 if it exited normally
+	Signal    syscall.Signal
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  time.Duration
+	PID       int
+	// LastWorkDir is the working directory when the execution finished
+	LastWorkDir string
+	// Lines and Bytes count the output lines delivered to the output func,
+	// the line endings are not counted in Bytes,
+	// Lines counts the chunks if ExecOptions.ChunkOutput is set
+	Lines    int
+	Bytes    int64
+	Canceled bool
+	TimedOut bool
+	// IdleTimedOut is true if it was stopped by ExecOptions.IdleTimeout
+	IdleTimedOut bool
+	// Outputs is parsed from the file of $GOSH_OUTPUT written by the script
+	Outputs map[string]string
+	// StepTimeouts are the commands added by AddCommandWithTimeout that timed out
+	StepTimeouts []StepTimeout
+}
+
+// Success reports whether the shell exited with code 0.
+func (r *ExecResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == 0
+}
+
+func (e *Exec) buildResult(endTime time.Time) *ExecResult {
+	e.outputMu.Lock()
+	lines, bytes := e.num, e.bytes
+	e.outputMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r := &ExecResult{
+		ID:           e.id,
+		ExitCode:     -1,
+		StartTime:    e.startTime,
+		EndTime:      endTime,
+		Duration:     endTime.Sub(e.startTime),
+		PID:          e.pid,
+		LastWorkDir:  e.lastWorkDir,
+		Lines:        lines,
+		Bytes:        bytes,
+		Canceled:     e.canceled || errors.Is(e.ctx.Err(), context.Canceled),
+		TimedOut:     errors.Is(e.ctx.Err(), context.DeadlineExceeded),
+		IdleTimedOut: e.idleTimedOut,
+		Outputs:      e.outputs,
+		StepTimeouts: append([]StepTimeout(nil), e.stepTimeouts...),
+	}
+	if e.exitCode != nil {
+		r.ExitCode = *e.exitCode
+	}
+	if state := e.cmd.ProcessState; state != nil {
+		r.ExitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			r.Signal = status.Signal()
+		}
+	}
+	return r
+}
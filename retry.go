@@ -0,0 +1,191 @@
+package sh
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Backoff returns the delay before the next attempt, attempt is the number of the failed attempt starting from 1.
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff waits the same delay before every retry.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff doubles the delay after every attempt from initial up to max, max is not limited if it is 0.
+// The delay is randomized by jitter, which is a fraction from 0 to 1,
+// e.g. 0.2 means the delay is between 80% and 120% of it.
+func ExponentialBackoff(initial, max time.Duration, jitter float64) Backoff {
+	return func(attempt int) time.Duration {
+		delay := float64(initial) * math.Pow(2, float64(attempt-1))
+		if max > 0 && delay > float64(max) {
+			delay = float64(max)
+		}
+		if jitter > 0 {
+			delay *= 1 + jitter*(2*rand.Float64()-1)
+		}
+		if delay > math.MaxInt64 {
+			return time.Duration(math.MaxInt64)
+		}
+		return time.Duration(delay)
+	}
+}
+
+// RetryPolicy controls how RunWithRetry runs the script again after it fails.
+type RetryPolicy struct {
+	// MaxAttempts is the number of the attempts including the first one, it is 1 if not positive.
+	MaxAttempts int
+	// Backoff is the delay before every retry, it is retried immediately if nil.
+	Backoff Backoff
+	// Retryable reports whether the error of an attempt is retried, it is DefaultRetryable if nil.
+	Retryable func(err error) bool
+	// OnRetry is called before waiting for the next attempt.
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+// DefaultRetryable retries when the shell exits with a non-zero code or is stopped by the idle timeout,
+// the executions canceled or timed out by the context are not retried.
+func DefaultRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+		return false
+	}
+	var exitErr *ExitError
+	return errors.As(err, &exitErr) || errors.Is(err, ErrIdleTimeout)
+}
+
+// RetryOnExitCodes retries when the shell exits with one of the codes.
+func RetryOnExitCodes(codes ...int) func(err error) bool {
+	return func(err error) bool {
+		if errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+			return false
+		}
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			return false
+		}
+		for _, code := range codes {
+			if exitErr.ExitCode == code {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RetryOnErrors retries when the error matches one of the targets by errors.Is.
+func RetryOnErrors(targets ...error) func(err error) bool {
+	return func(err error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts <= 0 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff(attempt)
+}
+
+// RunWithRetry runs the execution like Run, and runs the same script again by the policy if it fails.
+// Every retry is a new execution with the ID "<id>-<attempt>" and its own storage file,
+// the options, context and secrets are the same as this one.
+// It returns the last attempt and its error, the attempt is this execution if it is not retried.
+func (e *Exec) RunWithRetry(policy *RetryPolicy, command ...string) (*Exec, error) {
+	last := e
+	if policy.maxAttempts() > 1 {
+		if err := e.recordRetryScript(); err != nil {
+			return last, err
+		}
+	}
+	err := e.Run(command...)
+	for attempt := 1; attempt < policy.maxAttempts() && policy.retryable(err); attempt++ {
+		delay := policy.delay(attempt)
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, err, delay)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-e.ctx.Done():
+				timer.Stop()
+				return last, err
+			}
+		}
+
+		next, newErr := e.retryExec(attempt + 1)
+		if newErr != nil {
+			return last, newErr
+		}
+		last = next
+		err = next.Run()
+	}
+	return last, err
+}
+
+// recordRetryScript keeps the commands added from now on for the retries,
+// the ones added to the storage file before are read from it.
+func (e *Exec) recordRetryScript() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.started || e.finished {
+		return nil
+	}
+	if e.file != nil {
+		b, err := os.ReadFile(e.file.Name())
+		if err != nil {
+			return err
+		}
+		e.script.Reset()
+		e.script.Write(b[e.startRawLen:])
+	}
+	e.recordScript = true
+	return nil
+}
+
+// retryExec creates the execution of the attempt with the script of this one,
+// the script is written by Start, the shell must be reading stdin before a large script is written.
+func (e *Exec) retryExec(attempt int) (*Exec, error) {
+	opts := e.opts.Copy()
+	id := e.id + "-" + strconv.Itoa(attempt)
+	opts.IDCreator = func() string {
+		return id
+	}
+	next, err := NewExecContext(e.ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	next.secrets = e.secrets
+	next.recordScript = true
+
+	e.mu.Lock()
+	next.replay = append([]byte(nil), e.script.Bytes()...)
+	e.mu.Unlock()
+	return next, nil
+}
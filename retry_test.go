@@ -0,0 +1,205 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_RunWithRetry(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+	var lines []string
+	var retries []int
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {
+			lines = append(lines, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "x", ">>", counter); err != nil {
+		t.Fatal(err)
+	}
+	policy := &RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     ConstantBackoff(10 * time.Millisecond),
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			retries = append(retries, attempt)
+		},
+	}
+	last, err := e.RunWithRetry(policy, `n=$(wc -l < `+counter+`)`, `echo "attempt $n"`, `[ "$n" -ge 3 ]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.ID() != e.ID()+"-3" || !last.Result().Success() {
+		t.Errorf("last attempt: %s %+v", last.ID(), last.Result())
+	}
+	if e.Result().Success() {
+		t.Errorf("first attempt: %+v", e.Result())
+	}
+	if strings.Join(lines, "\n") != "attempt 1\nattempt 2\nattempt 3" {
+		t.Errorf("output: %q", lines)
+	}
+	if len(retries) != 2 || retries[0] != 1 || retries[1] != 2 {
+		t.Errorf("retries: %v", retries)
+	}
+}
+
+func TestExec_RunWithRetryExhausted(t *testing.T) {
+	storage := &Storage{Dir: t.TempDir(), NotAutoClean: true}
+	e, err := NewExec(&ExecOptions{
+		Shell:   &shell.Shell{Type: shell.Bash},
+		Storage: storage,
+		Output:  func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the command in the storage file before is retried
+	if err = e.AddCommand("echo", "start"); err != nil {
+		t.Fatal(err)
+	}
+	last, err := e.RunWithRetry(&RetryPolicy{
+		MaxAttempts: 3,
+		Retryable:   RetryOnExitCodes(7),
+	}, "exit 7")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 7 {
+		t.Fatalf("err: %v", err)
+	}
+	if last.ID() != e.ID()+"-3" {
+		t.Errorf("last attempt: %s", last.ID())
+	}
+	// every attempt has its own script
+	for _, id := range []string{e.ID(), e.ID() + "-2", e.ID() + "-3"} {
+		b, err := os.ReadFile(filepath.Join(storage.Dir, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(b)) != "echo start\nexit 7" {
+			t.Errorf("script of %s: %q", id, b)
+		}
+	}
+}
+
+func TestExec_RunNotRecordScript(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo 1", "echo 2"); err != nil {
+		t.Fatal(err)
+	}
+	// only the commands before starting are kept without Coverage and RunWithRetry
+	if e.script.Len() != 0 {
+		t.Errorf("script: %q", e.script.Bytes())
+	}
+
+	s, err := NewSession(&ExecOptions{
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.Run("echo 1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.exec.script.Len() != 0 {
+		t.Errorf("session script: %q", s.exec.script.Bytes())
+	}
+}
+
+func TestExec_RunWithRetryNotRetryable(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell:  &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := e.RunWithRetry(&RetryPolicy{
+		MaxAttempts: 3,
+		Retryable:   RetryOnExitCodes(7),
+	}, "exit 3")
+	if err == nil || last != e {
+		t.Errorf("err: %v, last attempt: %s", err, last.ID())
+	}
+}
+
+func TestExec_RunWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	e, err := NewExecContext(ctx, &ExecOptions{
+		Shell:  &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	last, err := e.RunWithRetry(&RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     ConstantBackoff(time.Minute),
+	}, "exit 1")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || last != e {
+		t.Errorf("err: %v, last attempt: %s", err, last.ID())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %s", d)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second, 0)
+	for attempt, want := range map[int]time.Duration{
+		1:   100 * time.Millisecond,
+		2:   200 * time.Millisecond,
+		4:   800 * time.Millisecond,
+		5:   time.Second,
+		100: time.Second,
+	} {
+		if d := backoff(attempt); d != want {
+			t.Errorf("attempt %d: %s", attempt, d)
+		}
+	}
+	backoff = ExponentialBackoff(time.Second, 0, 0.5)
+	for i := 0; i < 100; i++ {
+		if d := backoff(2); d < time.Second || d > 3*time.Second {
+			t.Fatalf("jitter: %s", d)
+		}
+	}
+}
+
+func TestExec_RunWithRetryLargeScript(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e, err := NewExecContext(ctx, &ExecOptions{
+		Shell:  &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// larger than the pipe buffer of stdin
+	comment := "# " + strings.Repeat("x", 100*1024)
+	last, err := e.RunWithRetry(&RetryPolicy{MaxAttempts: 2}, comment, "exit 3")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 3 {
+		t.Errorf("err: %v", err)
+	}
+	if last.ID() != e.ID()+"-2" {
+		t.Errorf("last attempt: %s", last.ID())
+	}
+}
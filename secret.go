@@ -0,0 +1,113 @@
+package sh
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretMask replaces the secrets in the output, error messages and stored scripts.
+const SecretMask = "***"
+
+// secretMasker replaces the secrets and their base64 and URL-encoded variants
+type secretMasker struct {
+	mu       sync.RWMutex
+	variants map[string]struct{}
+	replacer *strings.Replacer
+}
+
+func newSecretMasker(secrets ...string) *secretMasker {
+	m := &secretMasker{}
+	m.add(secrets...)
+	return m
+}
+
+func (m *secretMasker) add(secrets ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for _, secret := range secrets {
+		for _, v := range secretVariants(secret) {
+			if _, ok := m.variants[v]; ok {
+				continue
+			}
+			if m.variants == nil {
+				m.variants = make(map[string]struct{})
+			}
+			m.variants[v] = struct{}{}
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	variants := make([]string, 0, len(m.variants))
+	for v := range m.variants {
+		variants = append(variants, v)
+	}
+	// the longer ones are replaced first, such as the padded base64
+	sort.Slice(variants, func(i, j int) bool {
+		if len(variants[i]) != len(variants[j]) {
+			return len(variants[i]) > len(variants[j])
+		}
+		return variants[i] < variants[j]
+	})
+	oldnew := make([]string, 0, len(variants)*2)
+	for _, v := range variants {
+		oldnew = append(oldnew, v, SecretMask)
+	}
+	m.replacer = strings.NewReplacer(oldnew...)
+}
+
+func (m *secretMasker) mask(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.replacer == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// maskBytes returns b itself if there is nothing to replace
+func (m *secretMasker) maskBytes(b []byte) []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.replacer == nil {
+		return b
+	}
+	s := string(b)
+	if masked := m.replacer.Replace(s); masked != s {
+		return []byte(masked)
+	}
+	return b
+}
+
+func (m *secretMasker) empty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replacer == nil
+}
+
+func secretVariants(secret string) []string {
+	if secret == "" {
+		return nil
+	}
+	return []string{
+		secret,
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.RawStdEncoding.EncodeToString([]byte(secret)),
+		base64.URLEncoding.EncodeToString([]byte(secret)),
+		base64.RawURLEncoding.EncodeToString([]byte(secret)),
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+	}
+}
+
+// AddSecret registers the secrets to be masked, it is safe to call from any goroutine.
+// The output already delivered is not masked.
+func (e *Exec) AddSecret(secrets ...string) {
+	e.secrets.add(secrets...)
+}
@@ -0,0 +1,77 @@
+package sh
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestSecretMasker(t *testing.T) {
+	secret := "s3cr/t+token?"
+	m := newSecretMasker(secret, "")
+	for _, s := range []string{
+		secret,
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.RawURLEncoding.EncodeToString([]byte(secret)),
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+	} {
+		if masked := m.mask("token=" + s + "!"); masked != "token=***!" {
+			t.Errorf("%s: %s", s, masked)
+		}
+	}
+	if b := []byte("nothing"); &m.maskBytes(b)[0] != &b[0] {
+		t.Error("maskBytes copies the bytes without secrets")
+	}
+	if !newSecretMasker().empty() {
+		t.Error("masker without secrets is not empty")
+	}
+}
+
+func TestExec_RunWithSecrets(t *testing.T) {
+	dir := t.TempDir()
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell:   &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		Storage: &Storage{Dir: dir, NotAutoClean: true},
+		Secrets: []string{"hunter2"},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddSecret("p@ss word")
+	_ = e.AddCommand("echo", "hunter2")
+	_ = e.AddCommand("printf '%s\\n' \"$(printf hunter2 | base64)\"")
+	_ = e.AddCommand("echo", "p%40ss+word")
+	_ = e.AddCommand("test", "'p@ss word'", "=", "x")
+	err = e.Run()
+
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if msg := err.Error(); strings.Contains(msg, "p@ss word") || !strings.Contains(msg, "***") {
+		t.Errorf("err: %s", msg)
+	}
+	for _, line := range output {
+		if strings.Contains(line, "hunter2") || strings.Contains(line, "aHVudGVyMg") || strings.Contains(line, "p%40ss") {
+			t.Errorf("secret in output: %s", line)
+		}
+	}
+
+	b, err := os.ReadFile(e.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "hunter2") || !strings.Contains(string(b), "echo ***\n") {
+		t.Errorf("stored script: %s", b)
+	}
+}
@@ -0,0 +1,277 @@
+package sh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Session keeps one shell running and runs the commands batch by batch,
+// so functions, variables and the work dir are kept between batches.
+//
+// The shell reads the batches from stdin, so commands of a batch must not read stdin.
+// The session is closed when the shell exits, such as a failing command with shell.ErrExit set
+// or calling exit in a batch.
+type Session struct {
+	exec *Exec
+
+	// runMu runs the batches one at a time
+	runMu sync.Mutex
+	// mu guards the fields below, the output is collected by the output goroutines
+	mu    sync.Mutex
+	index int
+	lines int // lines written to the shell
+	batch *batch
+}
+
+// BatchResult is the result of a batch run by Session.
+type BatchResult struct {
+	Index    int
+	ExitCode int
+	// LastWorkDir is the working directory when the batch finished
+	LastWorkDir string
+	// Output is the output lines of the batch, each line ends with '\n',
+	// it is the raw output if ExecOptions.ChunkOutput is set
+	Output    []byte
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  time.Duration
+}
+
+type batch struct {
+	index  int
+	start  time.Time
+	output bytes.Buffer
+	end    chan batchEnd
+}
+
+type batchEnd struct {
+	code    int
+	workDir string
+}
+
+func NewSession(execOpts ...*ExecOptions) (*Session, error) {
+	return NewSessionContext(context.Background(), execOpts...)
+}
+
+// NewSessionContext starts the shell of a session, it runs until Close is called or ctx is done.
+// Storage of the options is not used, the batches are written to stdin.
+func NewSessionContext(ctx context.Context, execOpts ...*ExecOptions) (*Session, error) {
+	opts := GlobalExecOptionsOverwrite(execOpts...).Copy()
+	opts.Storage = &Storage{}
+
+	e, err := NewExecContext(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		exec: e,
+	}
+	e.session = s
+	if err = e.Start(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	s.lines = e.startLines
+	e.mu.Unlock()
+	return s, nil
+}
+
+func (s *Session) ID() string {
+	return s.exec.ID()
+}
+
+func (s *Session) String() string {
+	return s.exec.String()
+}
+
+// Run writes the commands as a batch and waits for them to finish.
+// A non-zero exit status of the batch is reported as ExitError,
+// and the batch result is returned with it.
+func (s *Session) Run(command ...string) (*BatchResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	select {
+	case <-s.exec.Done():
+		return nil, ErrSessionClosed
+	default:
+	}
+
+	// the idle time is counted from the start of the batch
+	s.exec.touchOutput()
+	s.mu.Lock()
+	s.index++
+	b := &batch{
+		index: s.index,
+		start: time.Now(),
+		end:   make(chan batchEnd, 1),
+	}
+	s.batch = b
+	s.mu.Unlock()
+
+	raw := new(bytes.Buffer)
+	for _, c := range command {
+		raw.WriteString(strings.TrimSpace(c))
+		raw.WriteByte('\n')
+	}
+	raw.WriteString("{ ")
+	raw.WriteString(s.exec.printfKey("batch:%s:%s:%s", strconv.Itoa(b.index)+` "$?" "$(pwd)"`))
+	raw.WriteString("} 2>/dev/null")
+	raw.WriteByte('\n')
+
+	s.resetExec()
+	// the shell may exit before reading the batch, then its exit status is reported
+	if err := s.exec.AddRawCommand(raw.Bytes()); err != nil && !errors.Is(err, syscall.EPIPE) {
+		return nil, err
+	}
+	s.lines += bytes.Count(raw.Bytes(), []byte{'\n'})
+
+	var end batchEnd
+	select {
+	case end = <-b.end:
+	case <-s.exec.Done():
+		// the shell exits in the batch
+		return s.closedResult(b)
+	}
+
+	s.exec.mu.Lock()
+	s.exec.lastWorkDir = end.workDir
+	s.exec.mu.Unlock()
+
+	r := s.newResult(b, end)
+	if end.code != 0 {
+		return r, s.exec.newExitError(end.code, nil)
+	}
+	return r, nil
+}
+
+// resetExec resets the state of the last batch
+func (s *Session) resetExec() {
+	e := s.exec
+	e.outputMu.Lock()
+	e.lastCommand = ""
+	e.tail = nil
+	e.outputMu.Unlock()
+
+	e.mu.Lock()
+	e.startLines = s.lines
+	e.errReport = nil
+	e.lastStep = nil
+	e.mu.Unlock()
+}
+
+func (s *Session) newResult(b *batch, end batchEnd) *BatchResult {
+	endTime := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batch = nil
+	return &BatchResult{
+		Index:       b.index,
+		ExitCode:    end.code,
+		LastWorkDir: end.workDir,
+		Output:      append([]byte(nil), b.output.Bytes()...),
+		StartTime:   b.start,
+		EndTime:     endTime,
+		Duration:    endTime.Sub(b.start),
+	}
+}
+
+// running reports whether a batch is running
+func (s *Session) running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batch != nil
+}
+
+func (s *Session) closedResult(b *batch) (*BatchResult, error) {
+	result := s.exec.Result()
+	end := batchEnd{
+		code:    result.ExitCode,
+		workDir: result.LastWorkDir,
+	}
+	return s.newResult(b, end), s.exec.Wait()
+}
+
+// finishBatch is called with the marker "<index>:<exit status>:<work dir>"
+func (s *Session) finishBatch(val string) {
+	fields := strings.SplitN(val, ":", 3)
+	if len(fields) != 3 {
+		return
+	}
+	index, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batch != nil && s.batch.index == index {
+		s.batch.end <- batchEnd{
+			code:    code,
+			workDir: fields[2],
+		}
+	}
+}
+
+func (s *Session) collect(line []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batch != nil {
+		s.batch.output.Write(line)
+		s.batch.output.WriteByte('\n')
+	}
+}
+
+func (s *Session) collectChunk(chunk []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batch != nil {
+		s.batch.output.Write(chunk)
+	}
+}
+
+// Close closes stdin of the shell and waits for it to exit.
+func (s *Session) Close() error {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if err := s.exec.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return s.exec.Wait()
+}
+
+// AddSecret registers the secrets to be masked in the output of the following batches.
+func (s *Session) AddSecret(secrets ...string) {
+	s.exec.AddSecret(secrets...)
+}
+
+// Cancel stops the shell of the session by the stop policy.
+func (s *Session) Cancel() error {
+	return s.exec.Cancel()
+}
+
+// Signal sends sig to the process group of the session.
+func (s *Session) Signal(sig os.Signal) error {
+	return s.exec.Signal(sig)
+}
+
+// Done returns a channel that is closed when the shell has exited.
+func (s *Session) Done() <-chan struct{} {
+	return s.exec.Done()
+}
+
+// GetLastWorkDir returns the working directory after the last batch.
+func (s *Session) GetLastWorkDir() string {
+	return s.exec.GetLastWorkDir()
+}
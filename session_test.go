@@ -0,0 +1,83 @@
+package sh
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestSession_Run(t *testing.T) {
+	s, err := NewSession(&ExecOptions{
+		Shell: &shell.Shell{
+			Type: shell.Bash,
+			Set:  shell.PipeFail,
+		},
+		WorkDir: "/",
+		Output:  func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Run("greet() { echo \"hello $1\"; }", "NAME=world", "cd /tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Index != 1 || r.ExitCode != 0 || r.LastWorkDir != "/tmp" || len(r.Output) != 0 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	r, err = s.Run("greet $NAME", "pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Output) != "hello world\n/tmp\n" || s.GetLastWorkDir() != "/tmp" {
+		t.Errorf("unexpected result: %+v, output: %q", r, r.Output)
+	}
+
+	r, err = s.Run("echo failing", "false")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 1 || exitErr.Line != 2 || exitErr.Command != "false" {
+		t.Errorf("unexpected err: %v", err)
+	}
+	if r == nil || r.ExitCode != 1 || r.Index != 3 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	if r, err = s.Run("greet again"); err != nil || strings.TrimSpace(string(r.Output)) != "hello again" {
+		t.Errorf("run after failing: %+v, %v", r, err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Run("echo closed"); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("run after closed: %v", err)
+	}
+}
+
+func TestSession_Exit(t *testing.T) {
+	s, err := NewSession(&ExecOptions{
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Run("cd /usr", "echo ok"); err != nil {
+		t.Fatal(err)
+	}
+	// shell.ErrExit is set by default
+	r, err := s.Run("cd /tmp", "false", "echo unreachable")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 1 {
+		t.Errorf("unexpected err: %v", err)
+	}
+	if r == nil || r.ExitCode != 1 || r.LastWorkDir != "/tmp" || strings.Contains(string(r.Output), "unreachable") {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if _, err = s.Run("echo closed"); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("run after exit: %v", err)
+	}
+}
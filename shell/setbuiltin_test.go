@@ -19,7 +19,7 @@ func TestSetBuiltin(t *testing.T) {
 func BenchmarkSetBuiltin_String(b *testing.B) {
 	opt := ErrExit | PipeFail | Emacs | XTrace | ErrTrace
 	for i := 0; i < b.N; i++ {
-		opt.String()
+		_ = opt.String()
 	}
 }
 
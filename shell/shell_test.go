@@ -23,7 +23,7 @@ func BenchmarkShell_String(b *testing.B) {
 		Unset: Emacs,
 	}
 	for i := 0; i < b.N; i++ {
-		bashShell.String()
+		_ = bashShell.String()
 	}
 }
 
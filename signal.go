@@ -0,0 +1,69 @@
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Signal sends sig to the process group of the running execution.
+func (e *Exec) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("exec: unsupported signal: %s", sig)
+	}
+	e.mu.Lock()
+	pid, started := e.pid, e.started
+	e.mu.Unlock()
+	if !started || pid <= 0 {
+		return ErrNotStarted
+	}
+	select {
+	case <-e.exited:
+		return os.ErrProcessDone
+	default:
+	}
+	if err := syscall.Kill(-pid, s); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
+
+// NotifyForward relays the signals received by the current process to the execution,
+// SIGINT and SIGTERM are relayed if no signal is provided.
+// The shell runs in its own process group, so it does not receive Ctrl-C of the terminal without it.
+// Relaying stops when the execution is done or the returned func is called.
+func NotifyForward(e *Exec, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case sig := <-ch:
+				_ = e.Signal(sig)
+			case <-e.Done():
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package sh
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExec_Signal(t *testing.T) {
+	newExec := func() (*Exec, *[]string) {
+		lines := new([]string)
+		e, err := NewExec(&ExecOptions{
+			Output: func(num int, line []byte) {
+				*lines = append(*lines, string(line))
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, lines
+	}
+	contains := func(lines []string, want string) bool {
+		for _, line := range lines {
+			if line == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	e, lines := newExec()
+	if err := e.Signal(syscall.SIGUSR1); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("signal before start: %v", err)
+	}
+	if err := e.Start("trap 'echo got usr1; exit 0' USR1", "sleep 10 & wait"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := e.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*lines, "got usr1") {
+		t.Errorf("signal is not received: %q", *lines)
+	}
+	if err := e.Signal(syscall.SIGUSR1); !errors.Is(err, os.ErrProcessDone) {
+		t.Errorf("signal after done: %v", err)
+	}
+
+	e, lines = newExec()
+	if err := e.Start("trap 'echo got usr2; exit 0' USR2", "sleep 10 & wait"); err != nil {
+		t.Fatal(err)
+	}
+	stop := NotifyForward(e, syscall.SIGUSR2)
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*lines, "got usr2") {
+		t.Errorf("signal is not forwarded: %q", *lines)
+	}
+}
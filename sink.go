@@ -0,0 +1,216 @@
+package sh
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The sinks are output handlers that can be shared by executions,
+// they are safe for concurrent use and can be composed by MultiSink and PrefixSink.
+
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// WriterSink writes every line to w with a trailing '\n' in one Write call,
+// so it works with the writers of loggers, such as logrus.Logger.Writer() and log.Logger.Writer().
+func WriterSink(w io.Writer) OutputHandler {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) HandleLine(line Line) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(append(line.Data, '\n'))
+}
+
+// LoggerSink logs every line as the message with the metadata as key-value pairs,
+// log can be slog.Info or zap.SugaredLogger.Infow for example.
+func LoggerSink(log func(msg string, keysAndValues ...any)) OutputHandler {
+	return OutputHandlerFunc(func(line Line) {
+		log(string(line.Data),
+			"exec_id", line.ExecID,
+			"stream", line.Stream.String(),
+			"num", line.Num,
+			"xtrace", line.XTrace,
+		)
+	})
+}
+
+// OutputHandlerFunc adapts a func to OutputHandler.
+type OutputHandlerFunc func(line Line)
+
+func (f OutputHandlerFunc) HandleLine(line Line) {
+	f(line)
+}
+
+// jsonLine is a line of JSON Lines
+type jsonLine struct {
+	ExecID string    `json:"exec_id"`
+	Stream string    `json:"stream"`
+	Num    int       `json:"num"`
+	Time   time.Time `json:"time"`
+	// Elapsed is in milliseconds
+	Elapsed float64 `json:"elapsed"`
+	XTrace  bool    `json:"xtrace,omitempty"`
+	Line    string  `json:"line"`
+}
+
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// JSONSink writes every line to w as a JSON object in one line, such as
+//
+//	{"exec_id":"...","stream":"stdout","num":1,"time":"...","elapsed":1.5,"line":"hello"}
+//
+// The invalid UTF-8 of the line is replaced by U+FFFD.
+func JSONSink(w io.Writer) OutputHandler {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) HandleLine(line Line) {
+	l := &jsonLine{
+		ExecID:  line.ExecID,
+		Stream:  line.Stream.String(),
+		Num:     line.Num,
+		Time:    line.Time,
+		Elapsed: float64(line.Elapsed) / float64(time.Millisecond),
+		XTrace:  line.XTrace,
+		Line:    string(line.Data),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(l)
+}
+
+type prefixSink struct {
+	prefix func(line Line) string
+	next   OutputHandler
+}
+
+// PrefixSink prefixes every line before passing it to next,
+// the prefix is "[<exec id>] " if prefix is nil.
+func PrefixSink(next OutputHandler, prefix func(line Line) string) OutputHandler {
+	if prefix == nil {
+		prefix = func(line Line) string {
+			return "[" + line.ExecID + "] "
+		}
+	}
+	return &prefixSink{prefix: prefix, next: next}
+}
+
+func (s *prefixSink) HandleLine(line Line) {
+	p := s.prefix(line)
+	data := make([]byte, 0, len(p)+len(line.Data))
+	data = append(data, p...)
+	line.Data = append(data, line.Data...)
+	s.next.HandleLine(line)
+}
+
+type multiSink []OutputHandler
+
+// MultiSink passes every line to all the handlers in order,
+// each handler owns its copy of the line data.
+func MultiSink(handlers ...OutputHandler) OutputHandler {
+	return multiSink(handlers)
+}
+
+func (s multiSink) HandleLine(line Line) {
+	data := line.Data
+	for i, h := range s {
+		if i > 0 {
+			line.Data = append([]byte(nil), data...)
+		}
+		h.HandleLine(line)
+	}
+}
+
+// FileSink appends the lines of every execution to "<exec id>.log" in Dir.
+// The files are kept open until CloseExec or Close is called.
+type FileSink struct {
+	Dir string
+	// Perm is the permission of the created files, it is 0644 if 0
+	Perm os.FileMode
+
+	mu    sync.Mutex
+	files map[string]*os.File
+	err   error
+}
+
+func (s *FileSink) HandleLine(line Line) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.file(line.ExecID)
+	if err == nil {
+		_, err = f.Write(append(line.Data, '\n'))
+	}
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// file must be called with mu held
+func (s *FileSink) file(id string) (*os.File, error) {
+	if f, ok := s.files[id]; ok {
+		return f, nil
+	}
+	perm := s.Perm
+	if perm == 0 {
+		perm = 0o644
+	}
+	f, err := os.OpenFile(s.Path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	if s.files == nil {
+		s.files = make(map[string]*os.File)
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+// Path returns the log file of the execution.
+func (s *FileSink) Path(id string) string {
+	return filepath.Join(s.Dir, id+".log")
+}
+
+// Err returns the first error of opening or writing the files.
+func (s *FileSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// CloseExec closes the log file of the execution, it is opened again if more lines are received.
+func (s *FileSink) CloseExec(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return nil
+	}
+	delete(s.files, id)
+	return f.Close()
+}
+
+// Close closes all the log files.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for id, f := range s.files {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(s.files, id)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package sh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSinks(t *testing.T) {
+	line := Line{
+		ExecID:  "id1",
+		Stream:  Stderr,
+		Num:     2,
+		Time:    time.Now(),
+		Elapsed: 1500 * time.Microsecond,
+		Data:    []byte("hello"),
+	}
+
+	text := new(bytes.Buffer)
+	jsonl := new(bytes.Buffer)
+	var logged []string
+	files := &FileSink{Dir: t.TempDir()}
+	h := MultiSink(
+		PrefixSink(WriterSink(text), nil),
+		JSONSink(jsonl),
+		LoggerSink(func(msg string, keysAndValues ...any) {
+			logged = append(logged, fmt.Sprint(append([]any{msg}, keysAndValues...)...))
+		}),
+		files,
+	)
+	h.HandleLine(line)
+	line.Num++
+	line.Data = []byte("world")
+	h.HandleLine(line)
+
+	if text.String() != "[id1] hello\n[id1] world\n" {
+		t.Errorf("text: %q", text.String())
+	}
+
+	var l jsonLine
+	if err := json.Unmarshal(bytes.SplitN(jsonl.Bytes(), []byte{'\n'}, 2)[0], &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.ExecID != "id1" || l.Stream != "stderr" || l.Num != 2 || l.Elapsed != 1.5 || l.Line != "hello" {
+		t.Errorf("json: %s", jsonl.String())
+	}
+
+	if len(logged) != 2 || !strings.HasPrefix(logged[0], "hello") {
+		t.Errorf("logged: %q", logged)
+	}
+
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(files.Path("id1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello\nworld\n" || files.Err() != nil {
+		t.Errorf("file: %q, err: %v", b, files.Err())
+	}
+}
+
+func TestExec_RunFileSink(t *testing.T) {
+	files := &FileSink{Dir: t.TempDir()}
+	defer files.Close()
+	e, err := NewExec(&ExecOptions{
+		OutputHandler: files,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err = files.CloseExec(e.ID()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(files.Path(e.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "+ echo hello\nhello\n" {
+		t.Errorf("file: %q", b)
+	}
+}
@@ -0,0 +1,66 @@
+package sh
+
+import "errors"
+
+// State is the state of an execution.
+type State uint8
+
+const (
+	StatePending State = iota
+	StateRunning
+	StateSucceeded
+	StateFailed
+	StateCanceled
+	StateTimedOut
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateRunning:
+		return "running"
+	case StateSucceeded:
+		return "succeeded"
+	case StateFailed:
+		return "failed"
+	case StateCanceled:
+		return "canceled"
+	case StateTimedOut:
+		return "timed out"
+	}
+	return "unknown"
+}
+
+// Finished reports whether the state is final.
+func (s State) Finished() bool {
+	return s >= StateSucceeded
+}
+
+// State returns the current state of the execution,
+// it is running until all output is delivered.
+// An execution stopped by ExecOptions.IdleTimeout is timed out.
+func (e *Exec) State() State {
+	select {
+	case <-e.done:
+	default:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.started {
+			return StateRunning
+		}
+		return StatePending
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case errors.Is(e.err, ErrTimeout), errors.Is(e.err, ErrIdleTimeout):
+		return StateTimedOut
+	case errors.Is(e.err, ErrCanceled):
+		return StateCanceled
+	case e.err != nil:
+		return StateFailed
+	}
+	return StateSucceeded
+}
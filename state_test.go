@@ -0,0 +1,148 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_StartWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	newExec := func(ctx context.Context) *Exec {
+		e, err := NewExecContext(ctx, &ExecOptions{
+			Output: func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	succeeded := newExec(context.Background())
+	failed := newExec(context.Background())
+	canceled := newExec(context.Background())
+	timedOut := newExec(ctx)
+
+	if s := succeeded.State(); s != StatePending {
+		t.Errorf("state before start: %s", s)
+	}
+	if err := succeeded.Wait(); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("wait before start: %v", err)
+	}
+
+	for e, command := range map[*Exec]string{
+		succeeded: "sleep 0.1",
+		failed:    "exit 2",
+		canceled:  "sleep 10",
+		timedOut:  "sleep 10",
+	} {
+		if err := e.Start(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := canceled.State(); s != StateRunning {
+		t.Errorf("state after start: %s", s)
+	}
+	if err := canceled.Start(); !errors.Is(err, ErrFinished) {
+		t.Errorf("start again: %v", err)
+	}
+
+	done := map[*Exec]<-chan struct{}{
+		succeeded: succeeded.Done(),
+		failed:    failed.Done(),
+		canceled:  canceled.Done(),
+		timedOut:  timedOut.Done(),
+	}
+	for len(done) > 0 {
+		select {
+		case <-done[succeeded]:
+			delete(done, succeeded)
+		case <-done[failed]:
+			delete(done, failed)
+			_ = canceled.Cancel()
+		case <-done[canceled]:
+			delete(done, canceled)
+		case <-done[timedOut]:
+			delete(done, timedOut)
+		}
+	}
+
+	want := map[*Exec]State{
+		succeeded: StateSucceeded,
+		failed:    StateFailed,
+		canceled:  StateCanceled,
+		timedOut:  StateTimedOut,
+	}
+	for e, state := range want {
+		if s := e.State(); s != state {
+			t.Errorf("state: %s, want: %s, err: %v", s, state, e.Wait())
+		}
+	}
+}
+
+func TestExec_CancelBeforeStart(t *testing.T) {
+	countFds := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip(err)
+		}
+		return len(fds)
+	}
+	before := countFds()
+	for i := 0; i < 10; i++ {
+		e, err := NewExec(&ExecOptions{
+			Output: func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Cancel(); !errors.Is(err, ErrCanceled) {
+			t.Errorf("cancel: %v", err)
+		}
+		if s := e.State(); s != StateCanceled {
+			t.Errorf("state: %s", s)
+		}
+	}
+	if after := countFds(); after > before {
+		t.Errorf("%d fds leaked", after-before)
+	}
+}
+
+func TestExec_StartLargeScript(t *testing.T) {
+	lines := 0
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {
+			lines++
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// larger than the pipe buffer of stdin, the shell reads them after sleeping
+	commands := []string{"sleep 1"}
+	for i := 0; i < 10000; i++ {
+		commands = append(commands, "echo 0123456789")
+	}
+	start := time.Now()
+	if err = e.Start(commands...); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("started after %s", d)
+	}
+	if err = e.AddCommand("echo added"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("add command after starting: %v", err)
+	}
+	if err = e.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 10000 {
+		t.Errorf("lines: %d", lines)
+	}
+}
@@ -0,0 +1,217 @@
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+const (
+	// stepTimeoutFunc is the function of bash running a command with a timeout
+	stepTimeoutFunc = "__gosh_timeout"
+	// stepReturn is the last command of stepTimeoutFunc, the ERR trap of the caller reports it
+	stepReturn = `return "$__gosh_rc"`
+)
+
+// StepTimeoutExitCode is the exit status of the command timed out, the same as timeout(1).
+const StepTimeoutExitCode = 124
+
+// StepTimeout is a command added by AddCommandWithTimeout that timed out.
+type StepTimeout struct {
+	// Line is the line number of the command in the script
+	Line    int
+	Command string
+	Timeout time.Duration
+}
+
+// step is a command running with a timeout, it is in its own process group
+type step struct {
+	pgid    int
+	line    int
+	command string
+	timeout time.Duration
+	// timedOut is set when the timeout marker is received
+	timedOut bool
+}
+
+// stepTimeoutCommand returns the function of bash running "$2" with the timeout of "$1" seconds.
+//
+// The command runs in its own process group by job control, so only it is stopped
+// by the stop policy when it times out, and the function returns StepTimeoutExitCode.
+// The process group is reported to the control channel to be stopped with the shell.
+func (e *Exec) stepTimeoutCommand() string {
+	policy := e.opts.Stop
+	sig := policy.signal()
+	grace := policy.gracePeriod()
+
+	builder := new(strings.Builder)
+	builder.WriteString(stepTimeoutFunc + "() { ")
+	// xtrace is restored by "local -" when returning
+	builder.WriteString(`{ local - __gosh_x=${-//[^x]/} __gosh_pid __gosh_wd __gosh_rc=0 __gosh_wrc=0; set +x; } 2>/dev/null; `)
+	builder.WriteString(`set -m; ( builtin trap - EXIT; eval "${__gosh_x:+set -x; }$2" ) </dev/null & __gosh_pid=$!; set +m; `)
+	builder.WriteString(e.printfKey(`step:%s\t%s\t%s\t%s`, `"$__gosh_pid" "${BASH_LINENO[0]}" "$1" "$2"`))
+	// the watchdog exits with StepTimeoutExitCode if the command has timed out,
+	// the subshells must not run the traps reporting the shell
+	fmt.Fprintf(builder, `( builtin trap - EXIT ERR; set +e; __gosh_f=0; builtin trap 'kill "$__gosh_s" 2>/dev/null; exit "$__gosh_f"' TERM; `+
+		`sleep "$1" & __gosh_s=$!; wait "$__gosh_s"; __gosh_f=%d; `, StepTimeoutExitCode)
+	builder.WriteString(e.printfKey("timeout:%s", `"$__gosh_pid"`))
+	fmt.Fprintf(builder, `kill -%d -- -"$__gosh_pid" 2>/dev/null; `, sig)
+	if sig != syscall.SIGKILL {
+		fmt.Fprintf(builder, `sleep %s & __gosh_s=$!; wait "$__gosh_s"; kill -%d -- -"$__gosh_pid" 2>/dev/null; `,
+			formatSeconds(grace), syscall.SIGKILL)
+	}
+	fmt.Fprintf(builder, `exit %d ) >/dev/null 2>&1 & __gosh_wd=$!; `, StepTimeoutExitCode)
+	// the job killed by a signal is not reported to stderr
+	builder.WriteString(`{ wait "$__gosh_pid"; } 2>/dev/null || __gosh_rc=$?; kill "$__gosh_wd" 2>/dev/null; wait "$__gosh_wd" || __gosh_wrc=$?; `)
+	builder.WriteString(e.printfKey("step-end:%s", `"$__gosh_pid"`))
+	fmt.Fprintf(builder, `[ "$__gosh_wrc" != %[1]d ] || __gosh_rc=%[1]d; %[2]s; }; `, StepTimeoutExitCode, stepReturn)
+	return builder.String()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// AddCommandWithTimeout adds a command which is stopped by the stop policy if it runs longer than timeout,
+// then it fails with StepTimeoutExitCode and the script goes on by its errexit policy.
+// The command runs in a subshell with stdin from /dev/null, so it cannot change the variables
+// or the work dir of the script. It is only supported by bash.
+func (e *Exec) AddCommandWithTimeout(timeout time.Duration, name string, args ...string) error {
+	if e.opts.Shell == nil || e.opts.Shell.Type != shell.Bash {
+		return errors.New("command timeout is only supported by bash")
+	}
+	if timeout <= 0 {
+		return e.AddCommand(name, args...)
+	}
+	if name == "" {
+		return nil
+	}
+	command := strings.TrimSpace(strings.Join(append([]string{name}, args...), " "))
+	return e.AddRawCommand([]byte(fmt.Sprintf("%s %s %s\n", stepTimeoutFunc, formatSeconds(timeout), shellQuote(command))))
+}
+
+// startStep is called with the marker "<pgid>\t<line>\t<timeout>\t<command>"
+func (e *Exec) startStep(val string) {
+	fields := strings.SplitN(val, "\t", 4)
+	if len(fields) != 4 {
+		return
+	}
+	pgid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	line, _ := strconv.Atoi(fields[1])
+	secs, _ := strconv.ParseFloat(fields[2], 64)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := &step{
+		pgid:    pgid,
+		line:    line - e.startLines,
+		command: e.secrets.mask(fields[3]),
+		timeout: time.Duration(secs * float64(time.Second)),
+	}
+	if e.steps == nil {
+		e.steps = make(map[int]*step)
+	}
+	e.steps[pgid] = s
+	e.lastStep = s
+}
+
+func (e *Exec) endStep(val string) {
+	pgid, err := strconv.Atoi(val)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.steps, pgid)
+}
+
+func (e *Exec) timeoutStep(val string) {
+	pgid, err := strconv.Atoi(val)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s, ok := e.steps[pgid]; ok {
+		s.timedOut = true
+		e.stepTimeouts = append(e.stepTimeouts, StepTimeout{
+			Line:    s.line,
+			Command: s.command,
+			Timeout: s.timeout,
+		})
+	}
+}
+
+// signalSteps sends sig to the process groups of the running steps, it reports whether any group exists.
+func (e *Exec) signalSteps(sig syscall.Signal) bool {
+	e.mu.Lock()
+	pgids := make([]int, 0, len(e.steps))
+	for pgid := range e.steps {
+		pgids = append(pgids, pgid)
+	}
+	e.mu.Unlock()
+	exists := false
+	for _, pgid := range pgids {
+		if syscall.Kill(-pgid, sig) == nil {
+			exists = true
+		}
+	}
+	return exists
+}
+
+// trimStep removes the frames of the step function from the report,
+// the failure in it or returned by it is reported as the step. It must be called with mu held.
+func (e *Exec) trimStep(r *errReport) {
+	inStep := len(r.stack) > 0 && r.stack[0].Function == stepTimeoutFunc
+	stack := r.stack[:0]
+	for _, frame := range r.stack {
+		if frame.Function != stepTimeoutFunc {
+			stack = append(stack, frame)
+		}
+	}
+	r.stack = stack
+	if (inStep || r.command == stepReturn) && e.lastStep != nil {
+		if inStep {
+			r.line = e.lastStep.line
+			r.source = ""
+		}
+		r.command = e.lastStep.command
+		r.step = e.lastStep
+	}
+}
+
+// traceStep reports the commands traced in a step at the line of the step,
+// LINENO is the line of stepTimeoutFunc in them. It must be called with outputMu held.
+func (e *Exec) traceStep(event *CommandEvent) {
+	if strings.HasPrefix(event.Command, stepTimeoutFunc+" ") {
+		e.stepLine = event.Line
+		return
+	}
+	inStep := len(event.Stack) > 0 && event.Stack[0] == stepTimeoutFunc
+	stack := event.Stack[:0]
+	for _, function := range event.Stack {
+		if function != stepTimeoutFunc {
+			stack = append(stack, function)
+		}
+	}
+	if len(stack) == 0 {
+		stack = nil
+	}
+	event.Stack = stack
+	if inStep {
+		event.Function = ""
+		if len(stack) > 0 {
+			event.Function = stack[0]
+		}
+		event.Line = e.stepLine
+		event.Source = ""
+	}
+}
@@ -0,0 +1,161 @@
+package sh
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_AddCommandWithTimeout(t *testing.T) {
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.PipeFail},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "start"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(100*time.Millisecond, "sleep", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "$?"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(5*time.Second, "echo", "fast"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("duration: %s", d)
+	}
+	if strings.Join(output, "\n") != "start\n124\nfast" {
+		t.Errorf("output: %q", output)
+	}
+	timeouts := e.Result().StepTimeouts
+	if len(timeouts) != 1 || timeouts[0].Line != 2 || timeouts[0].Command != "sleep 10" ||
+		timeouts[0].Timeout != 100*time.Millisecond {
+		t.Errorf("step timeouts: %+v", timeouts)
+	}
+}
+
+func TestExec_AddCommandWithTimeoutErrExit(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		Stop:  GracefulStopPolicy(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "start"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(100*time.Millisecond, "sleep", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "unreachable"); err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || !errors.Is(err, ErrStepTimeout) {
+		t.Fatalf("err: %v", err)
+	}
+	if exitErr.ExitCode != StepTimeoutExitCode || exitErr.Line != 2 || exitErr.Command != "sleep 10" ||
+		exitErr.Timeout != 100*time.Millisecond || len(exitErr.Stack) != 0 {
+		t.Errorf("exit error: %+v", exitErr)
+	}
+}
+
+func TestExec_AddCommandWithTimeoutFailure(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(time.Second, "exit", "3"); err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || errors.Is(err, ErrStepTimeout) {
+		t.Fatalf("err: %v", err)
+	}
+	if exitErr.ExitCode != 3 || exitErr.Line != 1 || exitErr.Command != "exit 3" || exitErr.Timeout != 0 {
+		t.Errorf("exit error: %+v", exitErr)
+	}
+}
+
+func TestExec_AddCommandWithTimeoutSh(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Sh},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(time.Second, "true"); err == nil {
+		t.Error("want an error for sh")
+	}
+}
+
+func TestExec_AddCommandWithTimeoutTrace(t *testing.T) {
+	var events []CommandEvent
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		CommandHandler: func(event CommandEvent) {
+			events = append(events, event)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommand("echo", "start"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(time.Second, "echo", "step"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.Command != "echo step" || last.Line != 2 || last.Function != "" || len(last.Stack) != 0 {
+		t.Errorf("events: %+v", events)
+	}
+}
+
+func TestExec_AddCommandWithTimeoutCancel(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.PipeFail},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.AddCommandWithTimeout(time.Minute, "sleep", "30"); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	e.Cancel()
+	_ = e.Wait()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("wait after cancel: %s", d)
+	}
+	if len(e.Result().StepTimeouts) != 0 {
+		t.Errorf("step timeouts: %+v", e.Result().StepTimeouts)
+	}
+}
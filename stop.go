@@ -0,0 +1,110 @@
+package sh
+
+import (
+	"syscall"
+	"time"
+)
+
+// stopPollInterval is the interval to check whether the process group has exited
+const stopPollInterval = 20 * time.Millisecond
+
+// StopPolicy controls how the process group is stopped
+// when the execution is canceled or its context is done.
+type StopPolicy struct {
+	// Signal is sent to the process group first, SIGKILL is sent if it is 0.
+	Signal syscall.Signal
+	// GracePeriod is how long to wait for the process group to exit after Signal,
+	// then SIGKILL is sent.
+	GracePeriod time.Duration
+}
+
+// KillStopPolicy sends SIGKILL immediately, it is the default policy.
+var KillStopPolicy = &StopPolicy{
+	Signal: syscall.SIGKILL,
+}
+
+// GracefulStopPolicy sends SIGTERM, and SIGKILL after the grace period.
+func GracefulStopPolicy(gracePeriod time.Duration) *StopPolicy {
+	return &StopPolicy{
+		Signal:      syscall.SIGTERM,
+		GracePeriod: gracePeriod,
+	}
+}
+
+func (p *StopPolicy) signal() syscall.Signal {
+	if p == nil || p.Signal == 0 {
+		return syscall.SIGKILL
+	}
+	return p.Signal
+}
+
+func (p *StopPolicy) gracePeriod() time.Duration {
+	if p.signal() == syscall.SIGKILL {
+		return 0
+	}
+	return p.GracePeriod
+}
+
+func (e *Exec) processGroup() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pid
+}
+
+// signalProcessGroup sends sig to the process group and the groups of the running steps,
+// it reports whether any group exists.
+func (e *Exec) signalProcessGroup(sig syscall.Signal) bool {
+	pid := e.processGroup()
+	if pid <= 0 {
+		return false
+	}
+	steps := e.signalSteps(sig)
+	// 关闭进程组，包括子进程
+	// 只调用c.cmd.Process.Kill()，子进程不会被杀死，原因来自go语言
+	// see: https://github.com/golang/go/issues/23019
+	return syscall.Kill(-pid, sig) == nil || steps
+}
+
+// stop sends the signal of the stop policy to the process group,
+// and SIGKILL if the shell has not exited after the grace period.
+// It does not wait, the rest of the process group is stopped by stopProcessGroup after the shell exits.
+func (e *Exec) stop() {
+	policy := e.opts.Stop
+	if !e.signalProcessGroup(policy.signal()) {
+		return
+	}
+	grace := policy.gracePeriod()
+	if grace <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			e.signalProcessGroup(syscall.SIGKILL)
+		case <-e.exited:
+		}
+	}()
+}
+
+// stopProcessGroup stops the processes still alive after the shell exits,
+// they are given the grace period of the stop policy to exit.
+func (e *Exec) stopProcessGroup() {
+	defer close(e.exited)
+	policy := e.opts.Stop
+	if !e.signalProcessGroup(policy.signal()) {
+		return
+	}
+	if grace := policy.gracePeriod(); grace > 0 {
+		deadline := time.Now().Add(grace)
+		for time.Now().Before(deadline) {
+			time.Sleep(stopPollInterval)
+			// the signal 0 checks whether the process group exists
+			if !e.signalProcessGroup(0) {
+				return
+			}
+		}
+	}
+	e.signalProcessGroup(syscall.SIGKILL)
+}
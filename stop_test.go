@@ -0,0 +1,66 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExec_StopGracefully(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var lines []string
+	e, err := NewExecContext(ctx, &ExecOptions{
+		Stop: GracefulStopPolicy(2 * time.Second),
+		Output: func(num int, line []byte) {
+			lines = append(lines, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run("trap 'echo cleanup; exit 143' TERM", "sleep 10 & wait")
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("err: %v", err)
+	}
+	if r := e.Result(); r.ExitCode != 143 || r.Duration >= 2*time.Second {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	for _, line := range lines {
+		if line == "cleanup" {
+			return
+		}
+	}
+	t.Errorf("cleanup trap is not run: %q", lines)
+}
+
+func TestExec_StopAfterGracePeriod(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Stop: &StopPolicy{
+			Signal:      syscall.SIGTERM,
+			GracePeriod: 300 * time.Millisecond,
+		},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Start("trap '' TERM", "sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	_ = e.Cancel()
+	err = e.Wait()
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("err: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Errorf("stopped after %s", d)
+	}
+	if r := e.Result(); r.Signal != syscall.SIGKILL {
+		t.Errorf("unexpected result: %+v", r)
+	}
+}
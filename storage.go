@@ -21,6 +21,58 @@ func (s *Storage) RemoveOrTruncate(file *os.File, size int64) error {
 	return os.Remove(file.Name())
 }
 
+// RemoveOrStrip removes the file, or strips head and tail bytes of it if NotAutoClean is set
+func (s *Storage) RemoveOrStrip(file *os.File, head, tail int64) error {
+	if file == nil {
+		return nil
+	}
+	if s.NotAutoClean {
+		return s.Strip(file, head, tail)
+	}
+	return os.Remove(file.Name())
+}
+
+// Strip removes head bytes from the beginning and tail bytes from the end of the file
+func (s *Storage) Strip(file *os.File, head, tail int64) error {
+	if file == nil {
+		return nil
+	}
+	if head == 0 {
+		return s.Truncate(file, tail)
+	}
+	content, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	size := int64(len(content))
+	if head+tail >= size {
+		content = content[:0]
+	} else {
+		content = content[head : size-tail]
+	}
+	if err = file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(content, 0)
+	return err
+}
+
+// Replace rewrites the content of the file by replace
+func (s *Storage) Replace(file *os.File, replace func(content []byte) []byte) error {
+	if file == nil {
+		return nil
+	}
+	content, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(replace(content), 0)
+	return err
+}
+
 func (s *Storage) Truncate(file *os.File, size int64) error {
 	if file == nil || size == 0 {
 		return nil
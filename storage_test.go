@@ -1,6 +1,8 @@
 package sh
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -16,3 +18,26 @@ func TestCheckStorage(t *testing.T) {
 		Dir: "/tmp/111",
 	}))
 }
+
+func TestStorage_RemoveOrStrip(t *testing.T) {
+	s := &Storage{
+		Dir:          t.TempDir(),
+		NotAutoClean: true,
+	}
+	e, err := NewExec(&ExecOptions{
+		Storage: s,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo hello world", "exit 0"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(s.Dir, e.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo hello world\nexit 0\n"; string(content) != want {
+		t.Errorf("stored script: %q, want %q", content, want)
+	}
+}
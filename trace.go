@@ -0,0 +1,110 @@
+package sh
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandEvent is a command traced by set -x, it is only reported by bash.
+type CommandEvent struct {
+	ExecID  string
+	Stream  Stream
+	Command string
+	// Line is the line number of the command in the script or Source
+	Line int
+	// Source is the file sourced by the script running the command, empty in the script itself
+	Source string
+	// Function is the function running the command, empty in the main script
+	Function string
+	// Stack is the function stack, the innermost first
+	Stack []string
+	// Depth is the nesting level of the command, such as 2 in a command substitution
+	Depth int
+	// Time is when the shell traced the command
+	Time time.Time
+}
+
+// String returns the command in the form of the default PS4, such as "++ echo hello"
+func (c CommandEvent) String() string {
+	return strings.Repeat("+", c.Depth) + " " + c.Command
+}
+
+// ps4 returns the PS4 of bash reporting the time, line number, functions and source of every traced command,
+// the first '+' is repeated by the nesting level.
+func (e *Exec) ps4() string {
+	return "PS4='+" + e.key("trace:") + "${EPOCHREALTIME-}\t${LINENO}\t${FUNCNAME[@]-}\t${BASH_SOURCE[0]-}\t'; "
+}
+
+// parseTrace parses the line written with the PS4 of ps4()
+func (e *Exec) parseTrace(stream Stream, line string) (CommandEvent, bool) {
+	trimmed := strings.TrimLeft(line, "+")
+	depth := len(line) - len(trimmed)
+	if depth == 0 {
+		return CommandEvent{}, false
+	}
+	val, ok := e.getKey("trace:", trimmed)
+	if !ok {
+		return CommandEvent{}, false
+	}
+	fields := strings.SplitN(val, "\t", 5)
+	if len(fields) != 5 {
+		return CommandEvent{}, false
+	}
+
+	event := CommandEvent{
+		ExecID:  e.id,
+		Stream:  stream,
+		Command: fields[4],
+		Depth:   depth,
+		Time:    parseEpochRealtime(fields[0]),
+	}
+	if stack := strings.Fields(fields[2]); len(stack) > 0 {
+		// the script file is run as the function "main"
+		if e.file != nil {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 {
+			event.Function = stack[0]
+			event.Stack = stack
+		}
+	}
+	event.Line, _ = strconv.Atoi(fields[1])
+	// the functions of the script read from stdin are in "main"
+	if source := fields[3]; source != "" && source != "main" && (e.file == nil || source != e.file.Name()) {
+		event.Source = source
+	} else {
+		e.mu.Lock()
+		event.Line -= e.startLines
+		e.mu.Unlock()
+	}
+	e.traceStep(&event)
+	return event, true
+}
+
+// parseEpochRealtime parses $EPOCHREALTIME, the decimal point depends on the locale
+func parseEpochRealtime(s string) time.Time {
+	sec, frac, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		if n, err := strconv.ParseInt(frac, 10, 64); err == nil {
+			nsec = n * int64(pow10(9-len(frac)))
+		}
+	}
+	return time.Unix(secs, nsec)
+}
+
+func pow10(n int) int {
+	p := 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,84 @@
+package sh
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_RunCommandHandler(t *testing.T) {
+	var events []CommandEvent
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		CommandHandler: func(event CommandEvent) {
+			events = append(events, event)
+		},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = e.Run("greet() {\n  echo \"hello $1\"\n}", "greet $(echo world)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(output, "\n") != "hello world" {
+		t.Errorf("output: %q", output)
+	}
+
+	want := []CommandEvent{
+		{Command: "echo world", Line: 4, Depth: 2},
+		{Command: "greet world", Line: 4, Depth: 1},
+		{Command: "echo 'hello world'", Line: 2, Function: "greet", Depth: 1},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events: %+v", events)
+	}
+	for i, event := range events {
+		w := want[i]
+		if event.Command != w.Command || event.Line != w.Line || event.Function != w.Function || event.Depth != w.Depth {
+			t.Errorf("event %d: %+v", i, event)
+		}
+		if event.ExecID != e.ID() || event.Time.Before(start.Add(-time.Second)) || event.Time.After(time.Now()) {
+			t.Errorf("event %d: %+v", i, event)
+		}
+	}
+}
+
+func TestExec_RunTracePlain(t *testing.T) {
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("echo $(echo hello)"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(output, "\n"); got != "++ echo hello\n+ echo hello\nhello" {
+		t.Errorf("output: %q", got)
+	}
+}
+
+func TestParseEpochRealtime(t *testing.T) {
+	for s, want := range map[string]time.Time{
+		"1700000000.123456": time.Unix(1700000000, 123456000),
+		"1700000000,5":      time.Unix(1700000000, 500000000),
+		"1700000000":        time.Unix(1700000000, 0),
+		"":                  {},
+	} {
+		if got := parseEpochRealtime(s); !got.Equal(want) {
+			t.Errorf("%q: %s, want: %s", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package sh
+
+import "strings"
+
+const (
+	// exitTrap reports the state of the shell when it exits
+	exitTrap = `{ __gosh_exit "$?"; } 2>/dev/null`
+	// errTrap reports the failing command, it keeps $? for the trap of the script chained after it.
+	// The failure of a command followed by "&& :" does not exit by errexit.
+	errTrap = `{ __gosh_err "$?" "$LINENO" && :; } 2>/dev/null`
+)
+
+// trapCommand returns the function of bash wrapping the builtin trap,
+// so the EXIT and ERR traps of the script are chained with the traps reporting the shell instead of replacing them.
+//
+// The EXIT trap of the script runs in a subshell with $? of the shell and without the ERR trap,
+// then the exit status is reported, it is the one passed to exit if the trap calls exit.
+// BASH_COMMAND is not changed by the commands of the trap, so the command exiting the shell is still reported.
+// The ERR trap of the script runs after the report. "trap -p" shows the chained traps.
+func (e *Exec) trapCommand() string {
+	pre := "{ __gosh_code=$?; } 2>/dev/null; (\n" +
+		`{ builtin trap - ERR; (exit "$__gosh_code") && :; } 2>/dev/null` + "\n"
+	post := "\n" + `{ exit "$__gosh_code"; } 2>/dev/null ) && :; ` + exitTrap
+
+	builder := new(strings.Builder)
+	builder.WriteString("__gosh_exit_pre=" + ansiQuote(pre) + "; ")
+	builder.WriteString("__gosh_exit_post=" + ansiQuote(post) + "; ")
+	builder.WriteString(`__gosh_trap() { case "$2" in EXIT|SIGEXIT|exit|0) `)
+	builder.WriteString(`if [ "$1" = - ] || [ -z "$1" ]; then builtin trap -- '` + exitTrap + `' EXIT; `)
+	builder.WriteString(`else builtin trap -- "$__gosh_exit_pre$1$__gosh_exit_post" EXIT; fi;; `)
+	builder.WriteString(`ERR|SIGERR|err) if [ "$1" = - ] || [ -z "$1" ]; then builtin trap -- '` + errTrap + `' ERR; `)
+	builder.WriteString(`else builtin trap -- '` + errTrap + `; '"$1" ERR; fi;; `)
+	builder.WriteString(`*) return 1;; esac; }; `)
+	// the options and the other signals are passed to the builtin
+	builder.WriteString(`trap() { { local - __gosh_a __gosh_s __gosh_r=(); set +x; } 2>/dev/null; [ "${1-}" != -- ] || shift; `)
+	builder.WriteString(`case "${1-}" in -l|-p|-P|'') builtin trap "$@"; return;; esac; `)
+	builder.WriteString(`if [ $# -eq 1 ]; then __gosh_a=-; else __gosh_a=$1; shift; fi; `)
+	builder.WriteString(`for __gosh_s in "$@"; do __gosh_trap "$__gosh_a" "$__gosh_s" || __gosh_r+=("$__gosh_s"); done; `)
+	builder.WriteString(`[ ${#__gosh_r[@]} -eq 0 ] || builtin trap -- "$__gosh_a" "${__gosh_r[@]}"; }; `)
+	return builder.String()
+}
+
+var ansiQuoteReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`)
+
+// ansiQuote quotes s in the ANSI-C quoting of bash, so it is kept in one line
+func ansiQuote(s string) string {
+	return "$'" + ansiQuoteReplacer.Replace(s) + "'"
+}
@@ -0,0 +1,118 @@
+package sh
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zdz1715/go-sh/shell"
+)
+
+func TestExec_RunUserExitTrap(t *testing.T) {
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.EXPipeFail},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run(`trap 'echo "cleanup $?"' EXIT`, "cd /tmp", "exit 3")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 3 || exitErr.Command != "exit 3" {
+		t.Fatalf("err: %v", err)
+	}
+	if dir := e.GetLastWorkDir(); dir != "/tmp" {
+		t.Errorf("last work dir: %q", dir)
+	}
+	if !strings.Contains(strings.Join(output, "\n"), "cleanup 3") {
+		t.Errorf("output: %q", output)
+	}
+}
+
+func TestExec_RunUserExitTrapExit(t *testing.T) {
+	e, err := NewExec(&ExecOptions{
+		Shell:  &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the exit status is the one passed to exit in the trap, and the reset trap still reports
+	err = e.Run("trap 'exit 5' EXIT INT", "trap - INT", "cd /tmp")
+	if r := e.Result(); err == nil || r.ExitCode != 5 {
+		t.Errorf("err: %v, result: %+v", err, r)
+	}
+	if dir := e.GetLastWorkDir(); dir != "/tmp" {
+		t.Errorf("last work dir: %q", dir)
+	}
+
+	e, err = NewExec(&ExecOptions{
+		Shell:  &shell.Shell{Type: shell.Bash},
+		Output: func(num int, line []byte) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Run("trap 'echo cleanup' EXIT", "trap - EXIT", "cd /tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if dir := e.GetLastWorkDir(); dir != "/tmp" {
+		t.Errorf("last work dir: %q", dir)
+	}
+}
+
+func TestExec_RunUserErrTrap(t *testing.T) {
+	var output []string
+	e, err := NewExec(&ExecOptions{
+		Shell: &shell.Shell{Type: shell.Bash, Set: shell.ErrExit},
+		Output: func(num int, line []byte) {
+			output = append(output, string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Run(`trap 'echo "failed $? at $LINENO"' ERR`, "echo ok", "false")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Line != 3 || exitErr.Command != "false" {
+		t.Fatalf("err: %v", err)
+	}
+	if len(output) != 2 || output[0] != "ok" || !strings.HasPrefix(output[1], "failed 1 at ") {
+		t.Errorf("output: %q", output)
+	}
+}
+
+// In sh, the EXIT trap of the script replaces the one reporting the state.
+func TestExec_RunUserExitTrapSh(t *testing.T) {
+	// the posix mode of bash replaces the trap like sh
+	for _, sh := range []*shell.Shell{{Type: shell.Sh}, {Type: shell.Bash, Set: shell.Posix}} {
+		e, err := NewExec(&ExecOptions{
+			Shell:  sh,
+			Output: func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Run("cd /tmp"); err != nil || e.GetLastWorkDir() != "/tmp" {
+			t.Fatalf("%s: err: %v, last work dir: %q", sh, err, e.GetLastWorkDir())
+		}
+
+		e, err = NewExec(&ExecOptions{
+			Shell:  sh,
+			Output: func(num int, line []byte) {},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run("trap 'echo cleanup' EXIT", "cd /tmp", "exit 3")
+		if r := e.Result(); err == nil || r.ExitCode != 3 {
+			t.Errorf("%s: err: %v, result: %+v", sh, err, r)
+		}
+		if dir := e.GetLastWorkDir(); dir != "" {
+			t.Errorf("%s: last work dir: %q", sh, dir)
+		}
+	}
+}